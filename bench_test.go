@@ -0,0 +1,68 @@
+package main
+
+import (
+	. "go-learn-sql/common"
+	"go-learn-sql/common/dbtest"
+	"go-learn-sql/seed"
+	"testing"
+)
+
+// BenchmarkInsertCustomers compares inserting b.N customers one row at a time
+// with a single BulkInsertCustomers, on both backends. For the 100k row
+// comparison, run
+//
+//	go test -run '^$' -bench InsertCustomers -benchtime 100000x
+//
+// The DAOs keep logging every call, since any of them may end the benchmark
+// with log.Fatal. Each run inserts under a client of its own, which is purged
+// afterwards along with its customers.
+func BenchmarkInsertCustomers(b *testing.B) {
+	params := dbtest.Params(b)
+	for _, name := range []string{"sql", "gorm"} {
+		b.Run(name+"/row-at-a-time", func(b *testing.B) {
+			dao, client, customers := prepareBenchmark(b, params, name)
+			b.ResetTimer()
+			for _, customer := range customers {
+				dao.InsertCustomer(customer.Code, customer.FirstName, customer.LastName, customer.EmailAddress, client)
+			}
+			reportRowsPerSecond(b)
+		})
+		b.Run(name+"/bulk", func(b *testing.B) {
+			dao, _, customers := prepareBenchmark(b, params, name)
+			b.ResetTimer()
+			if _, err := dao.BulkInsertCustomers(customers); err != nil {
+				b.Fatal(err)
+			}
+			reportRowsPerSecond(b)
+		})
+	}
+}
+
+// prepareBenchmark opens the backend and generates b.N customers for a new
+// benchmark client.
+func prepareBenchmark(b *testing.B, params DbParams, backend string) (Dao, Client, []Customer) {
+	dao := backends[backend](params)
+	b.Cleanup(dao.Shutdown)
+	client := dao.InsertClient("Bulk Insert Benchmark")
+	b.Cleanup(func() { dbtest.PurgeClient(b, params, client.Id) })
+	data, err := seed.Generate(seed.Config{Seed: 1, Clients: 1, CustomersPerClient: b.N})
+	if err != nil {
+		b.Fatal(err)
+	}
+	customers := make([]Customer, b.N)
+	for i, generated := range data.Customers {
+		customers[i] = Customer{
+			ClientId:     client.Id,
+			Code:         generated.Code,
+			FirstName:    generated.FirstName,
+			LastName:     generated.LastName,
+			EmailAddress: generated.EmailAddress,
+		}
+	}
+	return dao, client, customers
+}
+
+func reportRowsPerSecond(b *testing.B) {
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+}
@@ -0,0 +1,156 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Operation is one step of a batch. Apply runs it against a Dao that is
+// already inside the batch transaction.
+type Operation interface {
+	Apply(dao Dao) error
+	String() string
+}
+
+type BatchMode int
+
+const (
+	// AllOrNothing commits the batch only if every operation succeeds, and
+	// stops at the first failure.
+	AllOrNothing BatchMode = iota
+	// BestEffort runs every operation under its own savepoint, rolls back the
+	// ones that fail and commits the rest.
+	BestEffort
+)
+
+// ErrSkipped marks the operations an all-or-nothing batch never ran because
+// an earlier one failed.
+var ErrSkipped = errors.New("Skipped after an earlier failure")
+
+type BatchItemResult struct {
+	Operation Operation
+	Err       error
+}
+
+type BatchReport struct {
+	Results []BatchItemResult
+	// Committed is false when an all-or-nothing batch was rolled back, in which
+	// case even the results without an error did not stick.
+	Committed bool
+	// Attempts counts the runs of the batch transaction, retries included.
+	Attempts int
+}
+
+func (report BatchReport) Failed() int {
+	failed := 0
+	for _, result := range report.Results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// RollbackError picks the error to roll an all-or-nothing batch back with:
+// the failed item's own error when retrying the batch could help, otherwise
+// fallback.
+func (report BatchReport) RollbackError(fallback error) error {
+	for _, result := range report.Results {
+		if result.Err != nil && result.Err != ErrSkipped && IsRetryable(result.Err) {
+			return result.Err
+		}
+	}
+	return fallback
+}
+
+// ApplyBatch runs the operations against tx, which must be inside a
+// transaction, and reports how each one went. In best-effort mode every
+// operation gets a nested WithTx, i.e. a savepoint, of its own. The caller
+// commits or rolls back based on the report.
+func ApplyBatch(tx Dao, operations []Operation, mode BatchMode) BatchReport {
+	report := BatchReport{Results: make([]BatchItemResult, len(operations))}
+	failed := false
+	for i, operation := range operations {
+		report.Results[i].Operation = operation
+		switch {
+		case failed && mode == AllOrNothing:
+			report.Results[i].Err = ErrSkipped
+		case mode == BestEffort:
+			report.Results[i].Err = tx.WithTx(TxOptions{}, operation.Apply)
+		default:
+			report.Results[i].Err = operation.Apply(tx)
+			failed = report.Results[i].Err != nil
+		}
+	}
+	report.Committed = !failed
+	return report
+}
+
+type UpdateCustomerNameOp struct {
+	Customer    Customer
+	NewFullName string
+}
+
+func (op UpdateCustomerNameOp) Apply(dao Dao) error {
+	_, err := dao.UpdateCustomerName(op.Customer, op.NewFullName)
+	return err
+}
+
+func (op UpdateCustomerNameOp) String() string {
+	return fmt.Sprintf("Update customer %d name to %s", op.Customer.Id, op.NewFullName)
+}
+
+type UpdateCustomerEmailOp struct {
+	Customer Customer
+	NewEmail string
+}
+
+func (op UpdateCustomerEmailOp) Apply(dao Dao) error {
+	_, err := dao.PatchCustomer(op.Customer, CustomerPatch{EmailAddress: &op.NewEmail})
+	return err
+}
+
+func (op UpdateCustomerEmailOp) String() string {
+	return fmt.Sprintf("Update customer %d email address to %s", op.Customer.Id, op.NewEmail)
+}
+
+type UpdateProductNameOp struct {
+	Product Product
+	NewName string
+}
+
+func (op UpdateProductNameOp) Apply(dao Dao) error {
+	_, err := dao.UpdateProductName(op.Product, op.NewName)
+	return err
+}
+
+func (op UpdateProductNameOp) String() string {
+	return fmt.Sprintf("Update product %d name to %s", op.Product.Id, op.NewName)
+}
+
+type UpdateClientNameOp struct {
+	Client  Client
+	NewName string
+}
+
+func (op UpdateClientNameOp) Apply(dao Dao) error {
+	_, err := dao.UpdateClientName(op.Client, op.NewName)
+	return err
+}
+
+func (op UpdateClientNameOp) String() string {
+	return fmt.Sprintf("Update client %d name to %s", op.Client.Id, op.NewName)
+}
+
+type LinkCustomerToProductOp struct {
+	Customer Customer
+	Product  Product
+}
+
+func (op LinkCustomerToProductOp) Apply(dao Dao) error {
+	return dao.LinkCustomerToProduct(op.Customer, op.Product)
+}
+
+func (op LinkCustomerToProductOp) String() string {
+	return fmt.Sprintf("Link product %d to customer %d", op.Product.Id, op.Customer.Id)
+}
@@ -1,8 +1,11 @@
 package common
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -11,19 +14,206 @@ type Dao interface {
 	InsertClient(name string) Client
 	InsertCustomer(code, firstName string, lastName string, email string, client Client) Customer
 	InsertProduct(name string) Product
-	UpdateCustomerName(customer Customer, newFullName string)
-	UpdateProductName(product Product, newName string)
-	UpdateCustomerEmailAndLinkToProduct(customer Customer, newEmail string, product Product)
-	UpdateClientName(client Client, newName string)
-	DeleteClient(client Client)
-	DeleteCustomer(customer Customer)
-	DeleteAllCustomers()
-	DeleteAllProducts()
-	DeleteAllClients()
-	PrintDatabaseState()
+	BulkInsertCustomers(customers []Customer) ([]int64, error)
+	UpsertCustomer(code, firstName string, lastName string, email string, client Client) (Customer, UpsertResult, error)
+	UpdateCustomerName(customer Customer, newFullName string) (Customer, error)
+	UpdateProductName(product Product, newName string) (Product, error)
+	UpdateCustomerEmailAndLinkToProduct(customer Customer, newEmail string, product Product) (Customer, error)
+	UpdateClientName(client Client, newName string) (Client, error)
+	PatchCustomer(customer Customer, patch CustomerPatch) (Customer, error)
+	PatchProduct(product Product, patch ProductPatch) (Product, error)
+	PatchClient(client Client, patch ClientPatch) (Client, error)
+	ActivateClient(client Client) (Client, error)
+	DeactivateClient(client Client) (Client, error)
+	ActivateProduct(product Product) (Product, error)
+	DeactivateProduct(product Product) (Product, error)
+	LinkCustomerToProduct(customer Customer, product Product) error
+	ListClients(filter ListFilter) []Client
+	ListProducts(filter ListFilter) []Product
+	DeleteClient(client Client) error
+	DeleteCustomer(customer Customer) error
+	DeleteClientCascade(client Client, dryRun bool) (CascadeReport, error)
+	FindDuplicateCustomers(client Client) ([]DuplicateCandidate, error)
+	MergeCustomers(survivor Customer, duplicates []Customer) error
+	TransferCustomers(fromClient Client, toClient Client, customerIds []int64) (int64, error)
+	DeleteAllCustomers(confirm string) (int64, error)
+	DeleteAllProducts(confirm string) (int64, error)
+	DeleteAllClients(confirm string) (int64, error)
+	RestoreCustomer(customer Customer) (Customer, error)
+	RestoreProduct(product Product) (Product, error)
+	RestoreClient(client Client) (Client, error)
+	Purge(olderThan time.Duration) (int64, error)
+	RunBatch(operations []Operation, mode BatchMode) (BatchReport, error)
+	WithTx(options TxOptions, fn func(tx Dao) error) error
+	Snapshot() (State, error)
 	Shutdown()
 }
 
+// TxOptions configures WithTx. The zero value is a read-write transaction at
+// the database's default isolation level that is not retried. Calling WithTx
+// on the tx it hands out nests a savepoint in the open transaction instead:
+// if the inner fn fails only its own work is rolled back, the outer options
+// stay in force and nothing is retried short of the whole transaction.
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// Retry reruns the whole transaction, fn included, after a serialization
+	// failure or deadlock, so fn must be safe to run more than once.
+	Retry RetryPolicy
+	// OnRetry is told about every attempt that failed and is about to be
+	// retried.
+	OnRetry func(attempt int, err error)
+}
+
+// ListFilter narrows the records returned by the List* operations. The zero
+// value hides inactive records.
+type ListFilter struct {
+	IncludeInactive bool
+}
+
+var (
+	// ErrNotFound is returned by single-record updates and deletes when no live
+	// row has the given id.
+	ErrNotFound        = errors.New("Record not found")
+	ErrInactiveClient  = errors.New("Client is not active")
+	ErrInactiveProduct = errors.New("Product is not active")
+	// Soft-deleting a client does not trip the customer foreign key, so the
+	// DAOs check for live customers themselves.
+	ErrClientHasCustomers = errors.New("Client still has customers")
+	ErrSameClient         = errors.New("Source and target client are the same")
+	ErrInvalidMerge       = errors.New("Duplicates must be other live customers of the survivor's client")
+)
+
+// ConflictError reports an optimistic locking failure: the row was no longer
+// at Version when the update ran, so someone else changed it first.
+type ConflictError struct {
+	Table   string
+	Id      int64
+	Version int64
+}
+
+func (err *ConflictError) Error() string {
+	return fmt.Sprintf("%s %d was modified after version %d was read", err.Table, err.Id, err.Version)
+}
+
+// UpsertResult tells what an upsert did with the record it was given.
+type UpsertResult int
+
+const (
+	Unchanged UpsertResult = iota
+	Inserted
+	Updated
+)
+
+func (result UpsertResult) String() string {
+	switch result {
+	case Inserted:
+		return "inserted"
+	case Updated:
+		return "updated"
+	default:
+		return "unchanged"
+	}
+}
+
+// CascadeReport counts what DeleteClientCascade deleted, or would have deleted
+// on a dry run.
+type CascadeReport struct {
+	Links     int64
+	Customers int64
+	Clients   int64
+	DryRun    bool
+}
+
+// CustomerPatch lists the customer fields to change; nil fields keep whatever
+// is in the database, so a patch can be applied through a NewCustomer(id) stub.
+type CustomerPatch struct {
+	Code         *string
+	FirstName    *string
+	MiddleName   *string
+	LastName     *string
+	EmailAddress *string
+}
+
+func (patch CustomerPatch) Columns() map[string]interface{} {
+	columns := map[string]interface{}{}
+	setColumn(columns, "code", patch.Code)
+	setColumn(columns, "first_name", patch.FirstName)
+	setColumn(columns, "middle_name", patch.MiddleName)
+	setColumn(columns, "last_name", patch.LastName)
+	setColumn(columns, "email_address", patch.EmailAddress)
+	return columns
+}
+
+type ProductPatch struct {
+	Name *string
+}
+
+func (patch ProductPatch) Columns() map[string]interface{} {
+	columns := map[string]interface{}{}
+	setColumn(columns, "name", patch.Name)
+	return columns
+}
+
+type ClientPatch struct {
+	Name *string
+}
+
+func (patch ClientPatch) Columns() map[string]interface{} {
+	columns := map[string]interface{}{}
+	setColumn(columns, "name", patch.Name)
+	return columns
+}
+
+func setColumn(columns map[string]interface{}, name string, value *string) {
+	if value != nil {
+		columns[name] = *value
+	}
+}
+
+// String returns a pointer to value, for filling in patches.
+func String(value string) *string {
+	return &value
+}
+
+// DuplicateMatch says why two customers of a client look like the same person.
+type DuplicateMatch string
+
+const (
+	// MatchEmail is an exact, case-insensitive email address match.
+	MatchEmail DuplicateMatch = "email"
+	// MatchName is a match on first and last name once case, spaces and
+	// punctuation are stripped.
+	MatchName DuplicateMatch = "name"
+	// MatchSimilarName is a trigram similarity of the full names of at least
+	// DuplicateSimilarity.
+	MatchSimilarName DuplicateMatch = "similar name"
+)
+
+// DuplicateSimilarity is the pg_trgm similarity above which two full names
+// count as the same.
+const DuplicateSimilarity = 0.6
+
+// DuplicateCandidate pairs two customers that may be the same person; Customer
+// is always the older record.
+type DuplicateCandidate struct {
+	Customer   Customer
+	Duplicate  Customer
+	Match      DuplicateMatch
+	Similarity float64
+}
+
+// CodeCollisionError lists the customer codes that a transfer would duplicate
+// in the target client.
+type CodeCollisionError struct {
+	ClientId int64
+	Codes    []string
+}
+
+func (err *CodeCollisionError) Error() string {
+	return fmt.Sprintf("client %d already has customer code(s) %s", err.ClientId, strings.Join(err.Codes, ", "))
+}
+
 type DbParams struct {
 	Host     string
 	Port     uint16
@@ -31,6 +221,10 @@ type DbParams struct {
 	Password string
 	Database string
 	SslMode  string
+	// Protected marks a profile, such as production, in which the DeleteAll*
+	// methods refuse to run at all. Besides setting it here, it can be turned
+	// on with a protected=true url option or the ProtectedEnv variable.
+	Protected bool
 }
 
 var DefaultParams DbParams = DbParams{
@@ -56,14 +250,61 @@ func ConnectionString(params DbParams) string {
 		params.SslMode)
 }
 
+// ConnectionUrl spells out params as a url; a protected profile shows up as a
+// protected=true option, which only ParseConnectionUrl understands.
 func ConnectionUrl(params DbParams) string {
-	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s",
+	connectionUrl := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s",
 		params.Username,
 		params.Password,
 		params.Host,
 		params.Port,
 		params.Database,
 		params.SslMode)
+	if params.Protected {
+		connectionUrl += "&protected=true"
+	}
+	return connectionUrl
+}
+
+// ParseConnectionUrl is the inverse of ConnectionUrl. Parts the url leaves out
+// are taken from DefaultParams.
+func ParseConnectionUrl(connectionUrl string) (DbParams, error) {
+	params := DefaultParams
+	parsed, err := url.Parse(connectionUrl)
+	if err != nil {
+		return params, err
+	}
+	if parsed.Scheme != "postgres" && parsed.Scheme != "postgresql" {
+		return params, fmt.Errorf("unsupported database url scheme %q", parsed.Scheme)
+	}
+	if host := parsed.Hostname(); host != "" {
+		params.Host = host
+	}
+	if port := parsed.Port(); port != "" {
+		number, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return params, fmt.Errorf("invalid port %q", port)
+		}
+		params.Port = uint16(number)
+	}
+	if parsed.User != nil {
+		params.Username = parsed.User.Username()
+		if password, set := parsed.User.Password(); set {
+			params.Password = password
+		}
+	}
+	if database := strings.TrimPrefix(parsed.Path, "/"); database != "" {
+		params.Database = database
+	}
+	if sslMode := parsed.Query().Get("sslmode"); sslMode != "" {
+		params.SslMode = sslMode
+	}
+	if protected := parsed.Query().Get("protected"); protected != "" {
+		if params.Protected, err = strconv.ParseBool(protected); err != nil {
+			return params, fmt.Errorf("invalid protected option %q", protected)
+		}
+	}
+	return params, nil
 }
 
 type DataRecord struct {
@@ -71,9 +312,14 @@ type DataRecord struct {
 	CreatedAt time.Time
 }
 
+// UpdatableRecord rows are soft-deleted: deleting sets DeletedAt and every read
+// skips such rows until they are restored or purged. Version is bumped by every
+// update and checked by the update, so stale writes fail with a ConflictError.
 type UpdatableRecord struct {
 	DataRecord
 	UpdatedAt time.Time
+	DeletedAt *time.Time `sql:"index"`
+	Version   int64
 }
 
 type Client struct {
@@ -117,11 +363,32 @@ func NewProduct(id int64) Product {
 	return Product{UpdatableRecord: UpdatableRecord{DataRecord: DataRecord{Id: id}}}
 }
 
+// DistinctClientIds returns the ClientId of every customer, once each.
+func DistinctClientIds(customers []Customer) []int64 {
+	ids := make([]int64, len(customers))
+	for i, customer := range customers {
+		ids[i] = customer.ClientId
+	}
+	return DistinctIds(ids)
+}
+
+// DistinctIds returns ids without repeats, in first-seen order.
+func DistinctIds(ids []int64) []int64 {
+	seen := map[int64]bool{}
+	var distinct []int64
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			distinct = append(distinct, id)
+		}
+	}
+	return distinct
+}
+
 func SplitFullName(fullName string) (string, string, error) {
-	var err error
 	names := strings.Split(fullName, " ")
 	if len(names) != 2 {
-		err = errors.New("Invalid full name")
+		return "", "", errors.New("Invalid full name")
 	}
-	return names[0], names[1], err
+	return names[0], names[1], nil
 }
@@ -0,0 +1,25 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestSplitFullName(t *testing.T) {
+	tests := []struct {
+		fullName  string
+		first     string
+		last      string
+		wantError bool
+	}{
+		{"Ada Lovelace", "Ada", "Lovelace", false},
+		{"Cher", "", "", true},
+		{"", "", "", true},
+		{"Ada King Lovelace", "", "", true},
+	}
+	for _, test := range tests {
+		first, last, err := SplitFullName(test.fullName)
+		if first != test.first || last != test.last || (err != nil) != test.wantError {
+			t.Errorf("SplitFullName(%q) = %q, %q, %v", test.fullName, first, last, err)
+		}
+	}
+}
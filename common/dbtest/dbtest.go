@@ -0,0 +1,80 @@
+// Package dbtest connects tests and benchmarks to a Postgres database with the
+// schema in place, and skips them when there is none to connect to.
+package dbtest
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+	. "go-learn-sql/common"
+	"os"
+	"testing"
+)
+
+// DatabaseUrlEnv names the environment variable holding the url of the
+// database to test against; DefaultParams are used when it is not set.
+const DatabaseUrlEnv = "GO_LEARN_SQL_TEST_DATABASE"
+
+// Params returns the parameters of the test database, skipping tb when the
+// database cannot be reached.
+func Params(tb testing.TB) DbParams {
+	tb.Helper()
+	params := DefaultParams
+	if connectionUrl := os.Getenv(DatabaseUrlEnv); connectionUrl != "" {
+		var err error
+		if params, err = ParseConnectionUrl(connectionUrl); err != nil {
+			tb.Fatalf("%s: %v", DatabaseUrlEnv, err)
+		}
+	}
+	db := Open(tb, params)
+	if err := db.Ping(); err != nil {
+		tb.Skipf("No test database at %s:%d/%s: %v", params.Host, params.Port, params.Database, err)
+	}
+	return params
+}
+
+// Open opens a connection pool to the database that is closed when tb ends.
+func Open(tb testing.TB, params DbParams) *sql.DB {
+	tb.Helper()
+	db, err := sql.Open("postgres", ConnectionString(params))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	return db
+}
+
+// PurgeClient hard-deletes the client, its customers and their product links,
+// whether soft-deleted or not, and leaves every other row alone.
+func PurgeClient(tb testing.TB, params DbParams, clientId int64) {
+	tb.Helper()
+	purge(tb, params, clientId, []string{
+		"DELETE FROM customer_product WHERE customer_id IN (SELECT id FROM customer WHERE client_id = $1)",
+		"DELETE FROM customer WHERE client_id = $1",
+		"DELETE FROM client WHERE id = $1",
+	})
+}
+
+// PurgeProduct hard-deletes the product and its customer links.
+func PurgeProduct(tb testing.TB, params DbParams, productId int64) {
+	tb.Helper()
+	purge(tb, params, productId, []string{
+		"DELETE FROM customer_product WHERE product_id = $1",
+		"DELETE FROM product WHERE id = $1",
+	})
+}
+
+// purge runs the statements in order, with id as their only argument. It may
+// run in a cleanup, so it closes its own connection.
+func purge(tb testing.TB, params DbParams, id int64, statements []string) {
+	db, err := sql.Open("postgres", ConnectionString(params))
+	if err != nil {
+		tb.Error(err)
+		return
+	}
+	defer db.Close()
+	for _, statement := range statements {
+		if _, err = db.Exec(statement, id); err != nil {
+			tb.Errorf("%s with id %d: %v", statement, id, err)
+		}
+	}
+}
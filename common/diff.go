@@ -0,0 +1,226 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// StateDiff lists, table by table, what changed between two snapshots.
+type StateDiff struct {
+	Tables []TableDiff `json:"tables"`
+}
+
+// TableDiff holds the rows of one table that were added, removed or changed.
+// Rows are keyed by id, and links by the ids of their customer and product.
+type TableDiff struct {
+	Table   string    `json:"table"`
+	Added   []RowDiff `json:"added,omitempty"`
+	Removed []RowDiff `json:"removed,omitempty"`
+	Changed []RowDiff `json:"changed,omitempty"`
+}
+
+// RowDiff is an added or removed row with its Values, or a changed row with
+// just the fields that differ.
+type RowDiff struct {
+	Key     string        `json:"key"`
+	Values  []FieldValue  `json:"values,omitempty"`
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+type FieldValue struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// Empty reports whether the two snapshots were the same.
+func (diff StateDiff) Empty() bool {
+	for _, t := range diff.Tables {
+		if len(t.Added)+len(t.Removed)+len(t.Changed) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff compares two snapshots field by field, exported fields included, so
+// that a change the printed tables leave out, such as a new middle name or a
+// customer moving to another client, still shows. Added and changed rows come
+// in the order of after, removed rows in the order of before.
+func Diff(before State, after State) StateDiff {
+	return StateDiff{Tables: []TableDiff{
+		diffRows("Clients", clientDiffRows(before.Clients), clientDiffRows(after.Clients)),
+		diffRows("Products", productDiffRows(before.Products), productDiffRows(after.Products)),
+		diffRows("Customers", customerDiffRows(before.Customers), customerDiffRows(after.Customers)),
+		diffRows("Customer/Products", linkDiffRows(before.Links), linkDiffRows(after.Links)),
+	}}
+}
+
+// diffRow is a row of a snapshot as Diff sees it: the key it goes by in both
+// snapshots, and every field in a fixed order.
+type diffRow struct {
+	key    string
+	fields []FieldValue
+}
+
+func diffRows(title string, before []diffRow, after []diffRow) TableDiff {
+	diff := TableDiff{Table: title}
+	beforeRows := make(map[string]diffRow)
+	for _, row := range before {
+		beforeRows[row.key] = row
+	}
+	afterKeys := make(map[string]bool)
+	for _, row := range after {
+		afterKeys[row.key] = true
+		old, found := beforeRows[row.key]
+		if !found {
+			diff.Added = append(diff.Added, RowDiff{Key: row.key, Values: row.fields})
+			continue
+		}
+		var changes []FieldChange
+		for i, field := range row.fields {
+			if field.Value != old.fields[i].Value {
+				changes = append(changes, FieldChange{Field: field.Field, Before: old.fields[i].Value, After: field.Value})
+			}
+		}
+		if len(changes) > 0 {
+			diff.Changed = append(diff.Changed, RowDiff{Key: row.key, Changes: changes})
+		}
+	}
+	for _, row := range before {
+		if !afterKeys[row.key] {
+			diff.Removed = append(diff.Removed, RowDiff{Key: row.key, Values: row.fields})
+		}
+	}
+	return diff
+}
+
+// The *DiffRows functions name the fields as the JSON exports do.
+
+func clientDiffRows(clients []ClientRow) []diffRow {
+	rows := make([]diffRow, len(clients))
+	for i, client := range clients {
+		rows[i] = diffRow{key: formatId(client.Id), fields: []FieldValue{
+			{"id", formatId(client.Id)},
+			{"name", client.Name},
+			{"active", formatBool(client.Active)},
+			{"created_at", formatDiffTime(client.CreatedAt)},
+			{"updated_at", formatDiffTime(client.UpdatedAt)},
+		}}
+	}
+	return rows
+}
+
+func productDiffRows(products []ProductRow) []diffRow {
+	rows := make([]diffRow, len(products))
+	for i, product := range products {
+		rows[i] = diffRow{key: formatId(product.Id), fields: []FieldValue{
+			{"id", formatId(product.Id)},
+			{"name", product.Name},
+			{"active", formatBool(product.Active)},
+			{"created_at", formatDiffTime(product.CreatedAt)},
+			{"updated_at", formatDiffTime(product.UpdatedAt)},
+		}}
+	}
+	return rows
+}
+
+func customerDiffRows(customers []CustomerRow) []diffRow {
+	rows := make([]diffRow, len(customers))
+	for i, customer := range customers {
+		rows[i] = diffRow{key: formatId(customer.Id), fields: []FieldValue{
+			{"id", formatId(customer.Id)},
+			{"client_id", formatId(customer.ClientId)},
+			{"code", customer.Code},
+			{"first_name", customer.FirstName},
+			{"middle_name", customer.MiddleName},
+			{"last_name", customer.LastName},
+			{"email_address", customer.EmailAddress},
+			{"client_name", customer.ClientName},
+			{"created_at", formatDiffTime(customer.CreatedAt)},
+			{"updated_at", formatDiffTime(customer.UpdatedAt)},
+		}}
+	}
+	return rows
+}
+
+// linkDiffRows keys links by their ids, so that renaming a customer or product
+// changes its links rather than replacing them.
+func linkDiffRows(links []LinkRow) []diffRow {
+	rows := make([]diffRow, len(links))
+	for i, link := range links {
+		rows[i] = diffRow{key: formatId(link.CustomerId) + "/" + formatId(link.ProductId), fields: []FieldValue{
+			{"customer_id", formatId(link.CustomerId)},
+			{"product_id", formatId(link.ProductId)},
+			{"code", link.Code},
+			{"first_name", link.FirstName},
+			{"last_name", link.LastName},
+			{"product", link.Product},
+		}}
+	}
+	return rows
+}
+
+func formatDiffTime(value time.Time) string {
+	return value.Format(time.RFC3339Nano)
+}
+
+// RenderDiff writes diff to w as text or JSON. The text form lists only the
+// tables that changed, marking rows with +, - and ~.
+func RenderDiff(w io.Writer, diff StateDiff, format Format) error {
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(diff)
+	case FormatText:
+		return renderDiffText(w, diff)
+	}
+	return fmt.Errorf("output format %q is not supported for diffs", format)
+}
+
+func renderDiffText(w io.Writer, diff StateDiff) error {
+	var b strings.Builder
+	if diff.Empty() {
+		b.WriteString("No changes\n")
+	}
+	for _, t := range diff.Tables {
+		if len(t.Added)+len(t.Removed)+len(t.Changed) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "*** %s ***\n", t.Table)
+		for _, row := range t.Added {
+			fmt.Fprintf(&b, "+ %s: %s\n", row.Key, joinValues(row.Values))
+		}
+		for _, row := range t.Removed {
+			fmt.Fprintf(&b, "- %s: %s\n", row.Key, joinValues(row.Values))
+		}
+		for _, row := range t.Changed {
+			changes := make([]string, len(row.Changes))
+			for i, change := range row.Changes {
+				changes[i] = fmt.Sprintf("%s %q -> %q", change.Field, change.Before, change.After)
+			}
+			fmt.Fprintf(&b, "~ %s: %s\n", row.Key, strings.Join(changes, ", "))
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func joinValues(values []FieldValue) string {
+	fields := make([]string, len(values))
+	for i, value := range values {
+		fields[i] = fmt.Sprintf("%s=%q", value.Field, value.Value)
+	}
+	return strings.Join(fields, ", ")
+}
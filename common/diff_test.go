@@ -0,0 +1,32 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffShowsFieldsTheTablesLeaveOut(t *testing.T) {
+	before := State{Customers: []CustomerRow{{Id: 1, ClientId: 1, FirstName: "Shaquille", LastName: "O'Neal"}}}
+	after := State{Customers: []CustomerRow{{Id: 1, ClientId: 2, FirstName: "Shaquille", MiddleName: "Rashaun", LastName: "O'Neal"}}}
+	want := []FieldChange{
+		{Field: "client_id", Before: "1", After: "2"},
+		{Field: "middle_name", Before: "", After: "Rashaun"},
+	}
+	customers := Diff(before, after).Tables[2]
+	if len(customers.Changed) != 1 || !reflect.DeepEqual(customers.Changed[0].Changes, want) {
+		t.Errorf("customer changes = %+v, want %+v", customers.Changed, want)
+	}
+}
+
+func TestDiffKeysLinksByIds(t *testing.T) {
+	before := State{Links: []LinkRow{{CustomerId: 1, ProductId: 2, Code: "C-1", FirstName: "Ada", LastName: "Lovelace", Product: "Engine"}}}
+	after := State{Links: []LinkRow{{CustomerId: 1, ProductId: 2, Code: "C-1", FirstName: "Ada", LastName: "Byron", Product: "Engine"}}}
+	links := Diff(before, after).Tables[3]
+	if len(links.Added)+len(links.Removed) > 0 {
+		t.Errorf("renaming the customer added %+v and removed %+v", links.Added, links.Removed)
+	}
+	want := []RowDiff{{Key: "1/2", Changes: []FieldChange{{Field: "last_name", Before: "Lovelace", After: "Byron"}}}}
+	if !reflect.DeepEqual(links.Changed, want) {
+		t.Errorf("link changes = %+v, want %+v", links.Changed, want)
+	}
+}
@@ -0,0 +1,70 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// MassDeleteToken confirms a DeleteAll* call against a database whose name does
+// not look like a scratch database.
+const MassDeleteToken = "delete everything"
+
+// ScratchPatternEnv names the environment variable that overrides
+// DefaultScratchPattern.
+const ScratchPatternEnv = "GO_LEARN_SQL_SCRATCH_PATTERN"
+
+// ProtectedEnv names the environment variable that, set to true, opens every
+// DAO in a protected profile whatever its DbParams say.
+const ProtectedEnv = "GO_LEARN_SQL_PROTECTED"
+
+// DefaultScratchPattern matches the names of databases that mass deletes may
+// wipe without a confirmation token.
+const DefaultScratchPattern = `(^|_)(scratch|playground|test)(_|$)`
+
+var (
+	ErrMassDeleteProtected   = errors.New("Mass deletes are disabled in a protected profile")
+	ErrMassDeleteUnconfirmed = errors.New("Mass delete needs the confirmation token outside a scratch database")
+)
+
+// CheckMassDelete decides whether a DeleteAll* call may go ahead against the
+// database in params: never in a protected profile, and otherwise only with
+// the confirmation token or when the database name matches the scratch
+// pattern.
+func CheckMassDelete(params DbParams, confirm string) error {
+	if params.Protected {
+		return ErrMassDeleteProtected
+	}
+	if confirm == MassDeleteToken {
+		return nil
+	}
+	pattern := os.Getenv(ScratchPatternEnv)
+	if pattern == "" {
+		pattern = DefaultScratchPattern
+	}
+	scratch, err := regexp.MatchString(pattern, params.Database)
+	if err != nil {
+		return err
+	}
+	if !scratch {
+		return ErrMassDeleteUnconfirmed
+	}
+	return nil
+}
+
+// ApplyProfile marks params Protected when ProtectedEnv asks for it. The
+// environment can only add the protection, never lift it.
+func ApplyProfile(params DbParams) (DbParams, error) {
+	value := os.Getenv(ProtectedEnv)
+	if value == "" {
+		return params, nil
+	}
+	protected, err := strconv.ParseBool(value)
+	if err != nil {
+		return params, fmt.Errorf("invalid %s %q", ProtectedEnv, value)
+	}
+	params.Protected = params.Protected || protected
+	return params, nil
+}
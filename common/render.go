@@ -0,0 +1,155 @@
+package common
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go-learn-sql/common/table"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format names an output format for a State.
+type Format string
+
+const (
+	FormatText     Format = "text"
+	FormatJSON     Format = "json"
+	FormatCSV      Format = "csv"
+	FormatMarkdown Format = "markdown"
+	FormatHTML     Format = "html"
+)
+
+// Formats lists every supported output format.
+var Formats = []Format{FormatText, FormatJSON, FormatCSV, FormatMarkdown, FormatHTML}
+
+// ParseFormat looks up a format by name.
+func ParseFormat(name string) (Format, error) {
+	for _, format := range Formats {
+		if string(format) == name {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unknown output format %q", name)
+}
+
+// PrintDatabaseState takes a snapshot of dao and renders it to w.
+func PrintDatabaseState(w io.Writer, dao Dao, format Format, options table.Options) error {
+	state, err := dao.Snapshot()
+	if err != nil {
+		return err
+	}
+	return Render(w, state, format, options)
+}
+
+// Render writes state to w in the given format. Only the text format is sized
+// and colored by options; the others always carry every cell in full.
+func Render(w io.Writer, state State, format Format, options table.Options) error {
+	switch format {
+	case FormatText:
+		return renderText(w, state.Tables(time.RFC822), options)
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(state.nonNil())
+	case FormatCSV:
+		return renderCSV(w, state.Tables(time.RFC3339))
+	case FormatMarkdown:
+		return renderMarkdown(w, state.Tables(time.RFC822))
+	case FormatHTML:
+		return renderHTML(w, state.Tables(time.RFC822))
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+func renderText(w io.Writer, tables []table.Table, options table.Options) error {
+	for _, t := range tables {
+		if err := table.Render(w, t, options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderCSV writes each table as a CSV block headed by its title, with a blank
+// line between tables.
+func renderCSV(w io.Writer, tables []table.Table) error {
+	for i, t := range tables {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		writer := csv.NewWriter(w)
+		writer.Write([]string{t.Title})
+		writer.Write(t.Titles())
+		writer.WriteAll(t.Rows)
+		if err := writer.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renderMarkdown(w io.Writer, tables []table.Table) error {
+	escape := strings.NewReplacer("|", `\|`, "\n", " ")
+	line := func(cells []string) string {
+		escaped := make([]string, len(cells))
+		for i, cell := range cells {
+			escaped[i] = escape.Replace(cell)
+		}
+		return "| " + strings.Join(escaped, " | ") + " |"
+	}
+	for _, t := range tables {
+		rule := make([]string, len(t.Columns))
+		for i := range rule {
+			rule[i] = "---"
+		}
+		_, err := fmt.Fprintf(w, "## %s\n\n%s\n%s\n", t.Title, line(t.Titles()), line(rule))
+		if err != nil {
+			return err
+		}
+		for _, row := range t.Rows {
+			if _, err = fmt.Fprintln(w, line(row)); err != nil {
+				return err
+			}
+		}
+		if _, err = fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renderHTML(w io.Writer, tables []table.Table) error {
+	var b strings.Builder
+	for _, t := range tables {
+		fmt.Fprintf(&b, "<h2>%s</h2>\n<table>\n  <tr>", html.EscapeString(t.Title))
+		for _, title := range t.Titles() {
+			fmt.Fprintf(&b, "<th>%s</th>", html.EscapeString(title))
+		}
+		b.WriteString("</tr>\n")
+		for _, row := range t.Rows {
+			b.WriteString("  <tr>")
+			for _, cell := range row {
+				fmt.Fprintf(&b, "<td>%s</td>", html.EscapeString(cell))
+			}
+			b.WriteString("</tr>\n")
+		}
+		b.WriteString("</table>\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatId(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+func formatBool(value bool) string {
+	return strconv.FormatBool(value)
+}
@@ -0,0 +1,89 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how a transaction that failed with a serialization
+// failure or a deadlock is retried. The zero value never retries.
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt too.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy is what the DAOs use for their own transactional
+// operations.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   10 * time.Millisecond,
+	MaxDelay:    time.Second,
+}
+
+// RetryError is returned when a transaction still failed with a retryable
+// error after the policy's last attempt.
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (err *RetryError) Error() string {
+	return fmt.Sprintf("gave up after %d attempts: %v", err.Attempts, err.Err)
+}
+
+func (err *RetryError) Unwrap() error {
+	return err.Err
+}
+
+// IsRetryable reports whether err is a Postgres serialization failure (40001)
+// or deadlock (40P01), after which the whole transaction can be run again.
+func IsRetryable(err error) bool {
+	var state interface{ SQLState() string }
+	if !errors.As(err, &state) {
+		return false
+	}
+	code := state.SQLState()
+	return code == "40001" || code == "40P01"
+}
+
+// Run calls fn until it succeeds, fails with an error that is not retryable,
+// or runs out of attempts. onRetry, if set, hears about every failed attempt
+// that is about to be retried.
+func (policy RetryPolicy) Run(onRetry func(attempt int, err error), fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !IsRetryable(err) {
+			return err
+		}
+		if attempt >= policy.MaxAttempts {
+			if attempt == 1 {
+				return err
+			}
+			return &RetryError{Attempts: attempt, Err: err}
+		}
+		if onRetry != nil {
+			onRetry(attempt, err)
+		}
+		time.Sleep(policy.backoff(attempt))
+	}
+}
+
+// backoff doubles the delay with every attempt up to MaxDelay, then picks a
+// random point below it so that competing transactions do not retry in step.
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 1; i < attempt && (policy.MaxDelay == 0 || delay < policy.MaxDelay); i++ {
+		delay *= 2
+	}
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay)))
+}
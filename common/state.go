@@ -0,0 +1,147 @@
+package common
+
+import (
+	"go-learn-sql/common/table"
+	"time"
+)
+
+// State is a snapshot of the live records in the database, flattened into
+// rows that every output format can render.
+type State struct {
+	Clients   []ClientRow   `json:"clients"`
+	Products  []ProductRow  `json:"products"`
+	Customers []CustomerRow `json:"customers"`
+	Links     []LinkRow     `json:"links"`
+}
+
+type ClientRow struct {
+	Id        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ProductRow struct {
+	Id        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CustomerRow carries the client's id and the middle name for exports; the
+// printed table shows the client's name instead, and no middle name.
+type CustomerRow struct {
+	Id           int64     `json:"id"`
+	ClientId     int64     `json:"client_id"`
+	Code         string    `json:"code"`
+	FirstName    string    `json:"first_name"`
+	MiddleName   string    `json:"middle_name"`
+	LastName     string    `json:"last_name"`
+	EmailAddress string    `json:"email_address"`
+	ClientName   string    `json:"client_name"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// LinkRow is one customer/product link, ordered by the customer's last name.
+// The ids are not part of the printed table, which shows the customer code and
+// the product name.
+type LinkRow struct {
+	CustomerId int64  `json:"customer_id"`
+	ProductId  int64  `json:"product_id"`
+	Code       string `json:"code"`
+	FirstName  string `json:"first_name"`
+	LastName   string `json:"last_name"`
+	Product    string `json:"product"`
+}
+
+func NewClientRow(client Client) ClientRow {
+	return ClientRow{
+		Id:        client.Id,
+		Name:      client.Name,
+		Active:    client.Active,
+		CreatedAt: client.CreatedAt,
+		UpdatedAt: client.UpdatedAt,
+	}
+}
+
+func NewProductRow(product Product) ProductRow {
+	return ProductRow{
+		Id:        product.Id,
+		Name:      product.Name,
+		Active:    product.Active,
+		CreatedAt: product.CreatedAt,
+		UpdatedAt: product.UpdatedAt,
+	}
+}
+
+var (
+	idColumn        = table.Column{Title: "ID", Align: table.AlignRight}
+	nameColumn      = table.Column{Title: "Name", MaxWidth: 40, MinWidth: 10}
+	activeColumn    = table.Column{Title: "Active"}
+	createdAtColumn = table.Column{Title: "Created At", MinWidth: 19}
+	updatedAtColumn = table.Column{Title: "Updated At", MinWidth: 19}
+	codeColumn      = table.Column{Title: "Code", MaxWidth: 10}
+	firstNameColumn = table.Column{Title: "First Name", MaxWidth: 20, MinWidth: 6}
+	lastNameColumn  = table.Column{Title: "Last Name", MaxWidth: 20, MinWidth: 6}
+)
+
+// Tables lays the state out for the tabular output formats, with timestamps
+// in the given time layout.
+func (state State) Tables(layout string) []table.Table {
+	formatTime := func(value time.Time) string {
+		return value.Format(layout)
+	}
+	clients := table.Table{Title: "Clients", Columns: []table.Column{
+		idColumn, nameColumn, activeColumn, createdAtColumn, updatedAtColumn}}
+	for _, client := range state.Clients {
+		clients.Rows = append(clients.Rows, []string{
+			formatId(client.Id), client.Name, formatBool(client.Active),
+			formatTime(client.CreatedAt), formatTime(client.UpdatedAt)})
+	}
+	products := table.Table{Title: "Products", Columns: []table.Column{
+		idColumn, nameColumn, activeColumn, createdAtColumn, updatedAtColumn}}
+	for _, product := range state.Products {
+		products.Rows = append(products.Rows, []string{
+			formatId(product.Id), product.Name, formatBool(product.Active),
+			formatTime(product.CreatedAt), formatTime(product.UpdatedAt)})
+	}
+	customers := table.Table{Title: "Customers", Columns: []table.Column{
+		idColumn, codeColumn, firstNameColumn, lastNameColumn,
+		{Title: "Email", MaxWidth: 40, MinWidth: 10},
+		{Title: "Client", MaxWidth: 40, MinWidth: 10},
+		createdAtColumn, updatedAtColumn}}
+	for _, customer := range state.Customers {
+		customers.Rows = append(customers.Rows, []string{
+			formatId(customer.Id), customer.Code, customer.FirstName, customer.LastName,
+			customer.EmailAddress, customer.ClientName,
+			formatTime(customer.CreatedAt), formatTime(customer.UpdatedAt)})
+	}
+	links := table.Table{Title: "Customer/Products", Columns: []table.Column{
+		codeColumn, firstNameColumn, lastNameColumn,
+		{Title: "Product", MaxWidth: 40, MinWidth: 10}}}
+	for _, link := range state.Links {
+		links.Rows = append(links.Rows, []string{link.Code, link.FirstName, link.LastName, link.Product})
+	}
+	return []table.Table{clients, products, customers, links}
+}
+
+// nonNil swaps empty sections for empty slices, so that they encode as [] in
+// JSON rather than null.
+func (state State) nonNil() State {
+	if state.Clients == nil {
+		state.Clients = []ClientRow{}
+	}
+	if state.Products == nil {
+		state.Products = []ProductRow{}
+	}
+	if state.Customers == nil {
+		state.Customers = []CustomerRow{}
+	}
+	if state.Links == nil {
+		state.Links = []LinkRow{}
+	}
+	return state
+}
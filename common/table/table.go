@@ -0,0 +1,173 @@
+// Package table lays out rows of strings as aligned text tables that fit the
+// terminal, measuring cells by their display width rather than their length.
+package table
+
+import (
+	"fmt"
+	"github.com/mattn/go-runewidth"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Alignment int
+
+const (
+	AlignLeft Alignment = iota
+	AlignRight
+)
+
+// Column describes one column of a table. A column is as wide as its widest
+// cell, but no wider than MaxWidth when that is set; squeezing a table into
+// the terminal never takes a column below MinWidth.
+type Column struct {
+	Title    string
+	Align    Alignment
+	MinWidth int
+	MaxWidth int
+}
+
+// Table is a titled list of rows, each with one cell per column.
+type Table struct {
+	Title   string
+	Columns []Column
+	Rows    [][]string
+}
+
+// Titles lists the column titles.
+func (table Table) Titles() []string {
+	titles := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		titles[i] = column.Title
+	}
+	return titles
+}
+
+// Options control how a table is rendered. A zero Width leaves the columns at
+// their natural widths.
+type Options struct {
+	Width int
+	Color bool
+}
+
+const (
+	separator   = " | "
+	ellipsis    = "…"
+	minWidth    = 3
+	colorTitle  = "\x1b[1;36m"
+	colorHeader = "\x1b[1m"
+	colorRule   = "\x1b[2m"
+	colorReset  = "\x1b[0m"
+)
+
+// TerminalOptions sizes tables to the terminal behind f, falling back to the
+// COLUMNS environment variable, and colors them when f is a terminal and
+// NO_COLOR is not set.
+func TerminalOptions(f *os.File) Options {
+	var options Options
+	isTerminal := term.IsTerminal(int(f.Fd()))
+	if isTerminal {
+		if width, _, err := term.GetSize(int(f.Fd())); err == nil {
+			options.Width = width
+		}
+	}
+	if options.Width == 0 {
+		options.Width, _ = strconv.Atoi(os.Getenv("COLUMNS"))
+	}
+	_, noColor := os.LookupEnv("NO_COLOR")
+	options.Color = isTerminal && !noColor
+	return options
+}
+
+// Render writes the table to w, followed by its row count.
+func Render(w io.Writer, table Table, options Options) error {
+	widths := table.widths(options.Width)
+	total := len(separator) * (len(widths) - 1)
+	for _, width := range widths {
+		total += width
+	}
+	paint := func(color string, text string) string {
+		if !options.Color || text == "" {
+			return text
+		}
+		return color + text + colorReset
+	}
+	_, err := fmt.Fprintf(w, "%s\n%s\n%s\n",
+		paint(colorTitle, "*** "+table.Title+" ***"),
+		paint(colorHeader, table.line(table.Titles(), widths)),
+		paint(colorRule, strings.Repeat("-", total)))
+	if err != nil {
+		return err
+	}
+	for _, row := range table.Rows {
+		if _, err = fmt.Fprintln(w, table.line(row, widths)); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "Total: %d row(s)\n\n", len(table.Rows))
+	return err
+}
+
+// widths sizes each column to its widest cell, capped at MaxWidth, and then,
+// while the table is wider than limit, narrows the widest column that can
+// still give up space.
+func (table Table) widths(limit int) []int {
+	widths := make([]int, len(table.Columns))
+	for i, column := range table.Columns {
+		widths[i] = runewidth.StringWidth(column.Title)
+		for _, row := range table.Rows {
+			if width := runewidth.StringWidth(row[i]); width > widths[i] {
+				widths[i] = width
+			}
+		}
+		if column.MaxWidth > 0 && widths[i] > column.MaxWidth {
+			widths[i] = column.MaxWidth
+		}
+	}
+	if limit <= 0 {
+		return widths
+	}
+	total := len(separator) * (len(widths) - 1)
+	for _, width := range widths {
+		total += width
+	}
+	for total > limit {
+		widest := -1
+		for i, width := range widths {
+			if width > table.Columns[i].minWidth() && (widest < 0 || width > widths[widest]) {
+				widest = i
+			}
+		}
+		if widest < 0 {
+			break
+		}
+		widths[widest]--
+		total--
+	}
+	return widths
+}
+
+func (column Column) minWidth() int {
+	if column.MinWidth > 0 {
+		return column.MinWidth
+	}
+	return minWidth
+}
+
+// line pads or truncates each cell to its column width. Trailing padding is
+// dropped so that lines do not end in blanks.
+func (table Table) line(cells []string, widths []int) string {
+	padded := make([]string, len(cells))
+	for i, cell := range cells {
+		cell = runewidth.Truncate(cell, widths[i], ellipsis)
+		pad := strings.Repeat(" ", widths[i]-runewidth.StringWidth(cell))
+		if table.Columns[i].Align == AlignRight {
+			padded[i] = pad + cell
+		} else {
+			padded[i] = cell + pad
+		}
+	}
+	return strings.TrimRight(strings.Join(padded, separator), " ")
+}
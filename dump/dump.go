@@ -0,0 +1,270 @@
+// Package dump writes the playground tables out as a plain SQL script, schema
+// and data, and restores such a script, without needing pg_dump or psql.
+package dump
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Tables lists the dumped tables in dependency order: every table comes after
+// the tables its foreign keys refer to.
+var Tables = []string{"client", "product", "customer", "customer_product"}
+
+// BatchSize is the number of rows per INSERT statement.
+const BatchSize = 100
+
+// Write dumps the schema and rows of Tables to w. The script creates only what
+// does not exist yet, inserts the rows with their ids, and then moves each id
+// sequence past the highest id. It has no BEGIN or COMMIT of its own: Restore
+// runs it in one transaction, as does psql --single-transaction.
+//
+// Every table is read in one repeatable read transaction, so the dump is a
+// consistent snapshot: rows written while it runs cannot leave a link whose
+// customer was not dumped.
+func Write(w io.Writer, db *sql.DB) error {
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	// Nothing is written, so there is nothing to commit either.
+	defer tx.Rollback()
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "-- Logical dump of %s, taken %s\n\n", strings.Join(Tables, ", "), time.Now().UTC().Format(time.RFC3339))
+	if err = writeExtensions(out, tx); err != nil {
+		return err
+	}
+	var resets []string
+	for _, table := range Tables {
+		tableResets, err := writeSchema(out, tx, table)
+		if err != nil {
+			return fmt.Errorf("schema of %s: %w", table, err)
+		}
+		resets = append(resets, tableResets...)
+	}
+	for _, table := range Tables {
+		if err = writeRows(out, tx, table); err != nil {
+			return fmt.Errorf("rows of %s: %w", table, err)
+		}
+	}
+	for _, reset := range resets {
+		fmt.Fprintln(out, reset)
+	}
+	return out.Flush()
+}
+
+// writeExtensions lets the restored database use the same extensions, such as
+// pg_trgm for duplicate detection.
+func writeExtensions(out *bufio.Writer, tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT extname FROM pg_extension WHERE extname <> 'plpgsql' ORDER BY extname")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "CREATE EXTENSION IF NOT EXISTS %s;\n", pq.QuoteIdentifier(name))
+	}
+	out.WriteString("\n")
+	return rows.Err()
+}
+
+// writeSchema rebuilds the table's DDL from the catalog: its id sequences, the
+// columns with their defaults, the constraints, and the indexes that do not
+// back a constraint. It returns the statements that move the sequences past
+// the restored rows.
+func writeSchema(out *bufio.Writer, tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.Query(
+		`SELECT a.attname,
+			format_type(a.atttypid, a.atttypmod),
+			a.attnotnull,
+			coalesce(pg_get_expr(d.adbin, d.adrelid), ''),
+			coalesce(pg_get_serial_sequence($1::text, a.attname), '')
+		FROM pg_attribute a
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attrelid = $1::text::regclass
+		  AND a.attnum > 0
+		  AND NOT a.attisdropped
+		ORDER BY a.attnum`, table)
+	if err != nil {
+		return nil, err
+	}
+	var definitions, sequences, owned, resets []string
+	for rows.Next() {
+		var name, dataType, defaultValue, sequence string
+		var notNull bool
+		if err = rows.Scan(&name, &dataType, &notNull, &defaultValue, &sequence); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		definition := pq.QuoteIdentifier(name) + " " + dataType
+		if defaultValue != "" {
+			definition += " DEFAULT " + defaultValue
+		}
+		if notNull {
+			definition += " NOT NULL"
+		}
+		definitions = append(definitions, definition)
+		if sequence != "" {
+			sequences = append(sequences, sequence)
+			owned = append(owned, fmt.Sprintf("ALTER SEQUENCE %s OWNED BY %s.%s;",
+				sequence, pq.QuoteIdentifier(table), pq.QuoteIdentifier(name)))
+			resets = append(resets, fmt.Sprintf("SELECT setval(%s, coalesce(max(%s), 1), max(%s) IS NOT NULL) FROM %s;",
+				pq.QuoteLiteral(sequence), pq.QuoteIdentifier(name), pq.QuoteIdentifier(name), pq.QuoteIdentifier(table)))
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	constraints, err := queryStrings(tx,
+		`SELECT 'CONSTRAINT ' || quote_ident(conname) || ' ' || pg_get_constraintdef(oid)
+		FROM pg_constraint
+		WHERE conrelid = $1::regclass
+		ORDER BY contype = 'f', conname`, table)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := queryStrings(tx,
+		`SELECT indexdef
+		FROM pg_indexes
+		WHERE schemaname = current_schema()
+		  AND tablename = $1::text
+		  AND indexname NOT IN (SELECT conname FROM pg_constraint WHERE conrelid = $1::text::regclass)
+		ORDER BY indexname`, table)
+	if err != nil {
+		return nil, err
+	}
+	for _, sequence := range sequences {
+		fmt.Fprintf(out, "CREATE SEQUENCE IF NOT EXISTS %s;\n", sequence)
+	}
+	fmt.Fprintf(out, "CREATE TABLE IF NOT EXISTS %s (\n    %s\n);\n",
+		pq.QuoteIdentifier(table), strings.Join(append(definitions, constraints...), ",\n    "))
+	for _, statement := range owned {
+		fmt.Fprintln(out, statement)
+	}
+	for _, index := range indexes {
+		fmt.Fprintln(out, strings.Replace(index, " INDEX ", " INDEX IF NOT EXISTS ", 1)+";")
+	}
+	out.WriteString("\n")
+	return resets, nil
+}
+
+// writeRows writes every row of the table, soft-deleted ones included, as
+// batches of multi-row INSERTs in the order of the first column, the id.
+func writeRows(out *bufio.Writer, tx *sql.Tx, table string) error {
+	rows, err := tx.Query("SELECT * FROM " + pq.QuoteIdentifier(table) + " ORDER BY 1")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = pq.QuoteIdentifier(column)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES", pq.QuoteIdentifier(table), strings.Join(quoted, ", "))
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	count := 0
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return err
+		}
+		literals := make([]string, len(values))
+		for i, value := range values {
+			literals[i] = literal(value)
+		}
+		if count%BatchSize == 0 {
+			if count > 0 {
+				out.WriteString(";\n")
+			}
+			out.WriteString(insert + "\n    (")
+		} else {
+			out.WriteString(",\n    (")
+		}
+		out.WriteString(strings.Join(literals, ", ") + ")")
+		count++
+	}
+	if count > 0 {
+		out.WriteString(";\n")
+	}
+	out.WriteString("\n")
+	return rows.Err()
+}
+
+// literal renders a value scanned by lib/pq as a SQL literal, which Postgres
+// casts to the column's type on insert.
+func literal(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if value {
+			return "TRUE"
+		}
+		return "FALSE"
+	case int64:
+		return fmt.Sprint(value)
+	case float64:
+		return fmt.Sprint(value)
+	case time.Time:
+		return pq.QuoteLiteral(value.Format(time.RFC3339Nano))
+	case []byte:
+		return pq.QuoteLiteral(string(value))
+	}
+	return pq.QuoteLiteral(fmt.Sprint(value))
+}
+
+func queryStrings(tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// Restore runs a script written by Write in a single transaction, so that a
+// failing statement leaves the database as it was.
+func Restore(db *sql.DB, r io.Reader) error {
+	script, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// Without arguments lib/pq sends the script as one simple query, which
+	// may hold any number of statements.
+	if _, err = tx.Exec(string(script)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,204 @@
+package fixture
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func saveJSON(path string, fixture Fixture) error {
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func loadJSON(path string) (Fixture, error) {
+	var fixture Fixture
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fixture, err
+	}
+	err = json.Unmarshal(data, &fixture)
+	return fixture, err
+}
+
+// The CSV form is a directory with one file per table, named after the table,
+// each starting with a header row.
+
+var (
+	clientHeader   = []string{"id", "name", "active"}
+	productHeader  = []string{"id", "name", "active"}
+	customerHeader = []string{"id", "client_id", "code", "first_name", "middle_name", "last_name", "email_address"}
+	linkHeader     = []string{"customer_id", "product_id"}
+)
+
+func saveCSV(dir string, fixture Fixture) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, client := range fixture.Clients {
+		rows = append(rows, []string{formatId(client.Id), client.Name, strconv.FormatBool(client.Active)})
+	}
+	if err := writeCSV(filepath.Join(dir, "client.csv"), clientHeader, rows); err != nil {
+		return err
+	}
+	rows = nil
+	for _, product := range fixture.Products {
+		rows = append(rows, []string{formatId(product.Id), product.Name, strconv.FormatBool(product.Active)})
+	}
+	if err := writeCSV(filepath.Join(dir, "product.csv"), productHeader, rows); err != nil {
+		return err
+	}
+	rows = nil
+	for _, c := range fixture.Customers {
+		rows = append(rows, []string{formatId(c.Id), formatId(c.ClientId), c.Code,
+			c.FirstName, c.MiddleName, c.LastName, c.EmailAddress})
+	}
+	if err := writeCSV(filepath.Join(dir, "customer.csv"), customerHeader, rows); err != nil {
+		return err
+	}
+	rows = nil
+	for _, link := range fixture.Links {
+		rows = append(rows, []string{formatId(link.CustomerId), formatId(link.ProductId)})
+	}
+	return writeCSV(filepath.Join(dir, "customer_product.csv"), linkHeader, rows)
+}
+
+func writeCSV(path string, header []string, rows [][]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(f)
+	writer.Write(header)
+	writer.WriteAll(rows)
+	if err = writer.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func loadCSV(dir string) (Fixture, error) {
+	var fixture Fixture
+	err := readCSV(filepath.Join(dir, "client.csv"), clientHeader, func(row fields) {
+		fixture.Clients = append(fixture.Clients, ClientRecord{
+			Id: row.id("id"), Name: row["name"], Active: row.bool("active")})
+	})
+	if err != nil {
+		return fixture, err
+	}
+	err = readCSV(filepath.Join(dir, "product.csv"), productHeader, func(row fields) {
+		fixture.Products = append(fixture.Products, ProductRecord{
+			Id: row.id("id"), Name: row["name"], Active: row.bool("active")})
+	})
+	if err != nil {
+		return fixture, err
+	}
+	err = readCSV(filepath.Join(dir, "customer.csv"), customerHeader, func(row fields) {
+		fixture.Customers = append(fixture.Customers, CustomerRecord{
+			Id:           row.id("id"),
+			ClientId:     row.id("client_id"),
+			Code:         row["code"],
+			FirstName:    row["first_name"],
+			MiddleName:   row["middle_name"],
+			LastName:     row["last_name"],
+			EmailAddress: row["email_address"],
+		})
+	})
+	if err != nil {
+		return fixture, err
+	}
+	err = readCSV(filepath.Join(dir, "customer_product.csv"), linkHeader, func(row fields) {
+		fixture.Links = append(fixture.Links, LinkRecord{
+			CustomerId: row.id("customer_id"), ProductId: row.id("product_id")})
+	})
+	return fixture, err
+}
+
+// fields is a CSV row keyed by the header.
+type fields map[string]string
+
+// readCSV hands each row of the file to add. The header may list the columns
+// in any order, but must list all of them.
+func readCSV(path string, columns []string, add func(row fields)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("%s: missing header row", path)
+	}
+	header := records[0]
+	for _, column := range columns {
+		if indexOf(header, column) < 0 {
+			return fmt.Errorf("%s: missing column %s", path, column)
+		}
+	}
+	for line, record := range records[1:] {
+		row := make(fields)
+		for i, column := range header {
+			row[column] = record[i]
+		}
+		if err = row.check(columns); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line+2, err)
+		}
+		add(row)
+	}
+	return nil
+}
+
+// check makes sure that the id and flag columns parse, so that add can read
+// them without error handling.
+func (row fields) check(columns []string) error {
+	for _, column := range columns {
+		value := row[column]
+		switch {
+		case column == "id" || strings.HasSuffix(column, "_id"):
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				return fmt.Errorf("column %s: %w", column, err)
+			}
+		case column == "active":
+			if _, err := strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("column %s: %w", column, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (row fields) id(column string) int64 {
+	id, _ := strconv.ParseInt(row[column], 10, 64)
+	return id
+}
+
+func (row fields) bool(column string) bool {
+	value, _ := strconv.ParseBool(row[column])
+	return value
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func formatId(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
@@ -0,0 +1,196 @@
+// Package fixture exports the live contents of the database to JSON or CSV
+// files and imports them into an empty database through a Dao. The ids in a
+// fixture only tie its records together; imported records get new ids.
+package fixture
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	. "go-learn-sql/common"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+type Fixture struct {
+	Clients   []ClientRecord   `json:"clients"`
+	Products  []ProductRecord  `json:"products"`
+	Customers []CustomerRecord `json:"customers"`
+	Links     []LinkRecord     `json:"links"`
+}
+
+type ClientRecord struct {
+	Id     int64  `json:"id"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+}
+
+type ProductRecord struct {
+	Id     int64  `json:"id"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+}
+
+type CustomerRecord struct {
+	Id           int64  `json:"id"`
+	ClientId     int64  `json:"client_id"`
+	Code         string `json:"code"`
+	FirstName    string `json:"first_name"`
+	MiddleName   string `json:"middle_name"`
+	LastName     string `json:"last_name"`
+	EmailAddress string `json:"email_address"`
+}
+
+type LinkRecord struct {
+	CustomerId int64 `json:"customer_id"`
+	ProductId  int64 `json:"product_id"`
+}
+
+var ErrNotEmpty = errors.New("Fixtures can only be imported into an empty database")
+
+// Export captures the live clients, products, customers and links. It reads
+// them all in one read-only repeatable read transaction, so that every link
+// it exports points at a customer and a product it read as well.
+func Export(dao Dao) (Fixture, error) {
+	var state State
+	options := TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	err := dao.WithTx(options, func(tx Dao) error {
+		var err error
+		state, err = tx.Snapshot()
+		return err
+	})
+	if err != nil {
+		return Fixture{}, err
+	}
+	var fixture Fixture
+	for _, client := range state.Clients {
+		fixture.Clients = append(fixture.Clients, ClientRecord{Id: client.Id, Name: client.Name, Active: client.Active})
+	}
+	for _, product := range state.Products {
+		fixture.Products = append(fixture.Products, ProductRecord{Id: product.Id, Name: product.Name, Active: product.Active})
+	}
+	for _, customer := range state.Customers {
+		fixture.Customers = append(fixture.Customers, CustomerRecord{
+			Id:           customer.Id,
+			ClientId:     customer.ClientId,
+			Code:         customer.Code,
+			FirstName:    customer.FirstName,
+			MiddleName:   customer.MiddleName,
+			LastName:     customer.LastName,
+			EmailAddress: customer.EmailAddress,
+		})
+	}
+	for _, link := range state.Links {
+		fixture.Links = append(fixture.Links, LinkRecord{CustomerId: link.CustomerId, ProductId: link.ProductId})
+	}
+	return fixture, nil
+}
+
+// Progress is told how many of the records of a table have been imported so
+// far, out of total. Tables without records are not reported, so total is
+// never zero.
+type Progress func(table string, done int, total int)
+
+// Import inserts the fixture in one transaction, mapping the fixture's ids to
+// the ones the database hands out, and reports its progress when progress is
+// not nil. Inactive clients and products are deactivated last, since customers
+// cannot be added to an inactive client, nor linked to an inactive product.
+func Import(dao Dao, fixture Fixture, progress Progress) error {
+	if progress == nil {
+		progress = func(string, int, int) {}
+	}
+	log.Printf("Import %d client(s), %d product(s), %d customer(s) and %d link(s)",
+		len(fixture.Clients), len(fixture.Products), len(fixture.Customers), len(fixture.Links))
+	return dao.WithTx(TxOptions{}, func(tx Dao) error {
+		state, err := tx.Snapshot()
+		if err != nil {
+			return err
+		}
+		if len(state.Clients)+len(state.Products)+len(state.Customers) > 0 {
+			return ErrNotEmpty
+		}
+		clients := make(map[int64]Client)
+		for i, client := range fixture.Clients {
+			clients[client.Id] = tx.InsertClient(client.Name)
+			progress("client", i+1, len(fixture.Clients))
+		}
+		products := make(map[int64]Product)
+		for i, product := range fixture.Products {
+			products[product.Id] = tx.InsertProduct(product.Name)
+			progress("product", i+1, len(fixture.Products))
+		}
+		customers := make([]Customer, len(fixture.Customers))
+		for i, customer := range fixture.Customers {
+			client, found := clients[customer.ClientId]
+			if !found {
+				return fmt.Errorf("customer %d refers to unknown client %d", customer.Id, customer.ClientId)
+			}
+			customers[i] = Customer{
+				ClientId:     client.Id,
+				Code:         customer.Code,
+				FirstName:    customer.FirstName,
+				MiddleName:   customer.MiddleName,
+				LastName:     customer.LastName,
+				EmailAddress: customer.EmailAddress,
+			}
+		}
+		ids, err := tx.BulkInsertCustomers(customers)
+		if err != nil {
+			return err
+		}
+		if len(customers) > 0 {
+			progress("customer", len(customers), len(customers))
+		}
+		customerIds := make(map[int64]int64)
+		for i, customer := range fixture.Customers {
+			customerIds[customer.Id] = ids[i]
+		}
+		for i, link := range fixture.Links {
+			customerId, found := customerIds[link.CustomerId]
+			if !found {
+				return fmt.Errorf("link refers to unknown customer %d", link.CustomerId)
+			}
+			product, found := products[link.ProductId]
+			if !found {
+				return fmt.Errorf("link refers to unknown product %d", link.ProductId)
+			}
+			if err = tx.LinkCustomerToProduct(NewCustomer(customerId), product); err != nil {
+				return err
+			}
+			progress("customer_product", i+1, len(fixture.Links))
+		}
+		for _, product := range fixture.Products {
+			if !product.Active {
+				if _, err = tx.DeactivateProduct(products[product.Id]); err != nil {
+					return err
+				}
+			}
+		}
+		for _, client := range fixture.Clients {
+			if !client.Active {
+				if _, err = tx.DeactivateClient(clients[client.Id]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Save writes the fixture to a .json file, or as CSV files into the directory
+// at path otherwise.
+func Save(path string, fixture Fixture) error {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return saveJSON(path, fixture)
+	}
+	return saveCSV(path, fixture)
+}
+
+// Load reads a fixture written by Save.
+func Load(path string) (Fixture, error) {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return loadJSON(path)
+	}
+	return loadCSV(path)
+}
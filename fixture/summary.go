@@ -0,0 +1,71 @@
+package fixture
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TableSummary counts the rows of one table of a fixture, and checksums them
+// without their ids, so that two copies of the same data summarize the same
+// however their ids were handed out.
+type TableSummary struct {
+	Table    string
+	Rows     int
+	Checksum string
+}
+
+// Summarize summarizes every table of the fixture. Customers are identified by
+// their client's name and their code, and products by their name.
+func (fixture Fixture) Summarize() []TableSummary {
+	clientNames := make(map[int64]string)
+	var clients []string
+	for _, client := range fixture.Clients {
+		clientNames[client.Id] = client.Name
+		clients = append(clients, rowKey(client.Name, client.Active))
+	}
+	productNames := make(map[int64]string)
+	var products []string
+	for _, product := range fixture.Products {
+		productNames[product.Id] = product.Name
+		products = append(products, rowKey(product.Name, product.Active))
+	}
+	customerKeys := make(map[int64]string)
+	var customers []string
+	for _, c := range fixture.Customers {
+		customerKeys[c.Id] = rowKey(clientNames[c.ClientId], c.Code)
+		customers = append(customers, rowKey(clientNames[c.ClientId], c.Code,
+			c.FirstName, c.MiddleName, c.LastName, c.EmailAddress))
+	}
+	var links []string
+	for _, link := range fixture.Links {
+		links = append(links, rowKey(customerKeys[link.CustomerId], productNames[link.ProductId]))
+	}
+	return []TableSummary{
+		summarize("client", clients),
+		summarize("product", products),
+		summarize("customer", customers),
+		summarize("customer_product", links),
+	}
+}
+
+func summarize(table string, rows []string) TableSummary {
+	sort.Strings(rows)
+	hash := sha256.New()
+	for _, row := range rows {
+		hash.Write([]byte(row))
+		hash.Write([]byte{'\n'})
+	}
+	return TableSummary{Table: table, Rows: len(rows), Checksum: hex.EncodeToString(hash.Sum(nil))}
+}
+
+// rowKey joins values with a separator that cannot occur in them unquoted.
+func rowKey(values ...interface{}) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = fmt.Sprintf("%q", fmt.Sprint(value))
+	}
+	return strings.Join(quoted, ",")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	. "go-learn-sql/common"
+	"go-learn-sql/common/dbtest"
+	"go-learn-sql/common/table"
+	"go-learn-sql/scenario"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the scenario's snapshots")
+
+// TestScenarioGolden runs the playground scenario on each backend and compares
+// its normalized snapshots with testdata/basketball.<backend>.golden. After an
+// intended change to the output, rewrite the files with
+//
+//	go test -run ScenarioGolden -update
+//
+// The scenario ends by wiping every table, so it only runs against an empty
+// database, whose name must match the scratch pattern.
+func TestScenarioGolden(t *testing.T) {
+	params := dbtest.Params(t)
+	steps, err := scenario.Load("scenarios/basketball.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, backend := range []string{"sql", "gorm"} {
+		t.Run(backend, func(t *testing.T) {
+			dao := backends[backend](params)
+			defer dao.Shutdown()
+			state, err := dao.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(state.Clients)+len(state.Products)+len(state.Customers) > 0 {
+				t.Skip("The scenario needs an empty database")
+			}
+			observer := newGoldenObserver(t, dao)
+			if err = scenario.Run(dao, steps, observer); err != nil {
+				t.Fatal(err)
+			}
+			compareGolden(t, filepath.Join("testdata", "basketball."+backend+".golden"), observer.record.String())
+		})
+	}
+}
+
+// compareGolden reports the first line at which got differs from the golden
+// file at path, or rewrites the file with -update.
+func compareGolden(t *testing.T, path string, got string) {
+	t.Helper()
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Log("Updated golden file", path)
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run with -update to create it", err)
+	}
+	wantLines := strings.Split(string(want), "\n")
+	gotLines := strings.Split(got, "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var wantLine, gotLine string
+		if i < len(wantLines) {
+			wantLine = wantLines[i]
+		}
+		if i < len(gotLines) {
+			gotLine = gotLines[i]
+		}
+		if wantLine != gotLine {
+			t.Fatalf("Scenario output differs from %s at line %d\n  want: %s\n  got:  %s\nRun with -update if the change is intended",
+				path, i+1, wantLine, gotLine)
+		}
+	}
+}
+
+// goldenObserver records a snapshot of the database at every phase of the
+// scenario, normalized so that it comes out the same on every run: ids are
+// replaced by their order of first appearance in their table, and timestamps
+// are masked.
+type goldenObserver struct {
+	t      *testing.T
+	dao    Dao
+	ids    map[string]map[string]int
+	record strings.Builder
+}
+
+func newGoldenObserver(t *testing.T, dao Dao) *goldenObserver {
+	return &goldenObserver{t: t, dao: dao, ids: make(map[string]map[string]int)}
+}
+
+func (observer *goldenObserver) Step(string) {}
+
+func (observer *goldenObserver) Phase(name string) {
+	state, err := observer.dao.Snapshot()
+	if err != nil {
+		observer.t.Fatal(err)
+	}
+	fmt.Fprintf(&observer.record, "=== %s ===\n", name)
+	for _, t := range state.Tables(time.RFC3339) {
+		if err = table.Render(&observer.record, observer.normalize(t), table.Options{}); err != nil {
+			observer.t.Fatal(err)
+		}
+	}
+}
+
+func (observer *goldenObserver) normalize(t table.Table) table.Table {
+	ids := observer.ids[t.Title]
+	if ids == nil {
+		ids = make(map[string]int)
+		observer.ids[t.Title] = ids
+	}
+	normalized := t
+	normalized.Rows = make([][]string, len(t.Rows))
+	for i, row := range t.Rows {
+		normalized.Rows[i] = make([]string, len(row))
+		for j, cell := range row {
+			switch title := t.Columns[j].Title; {
+			case title == "ID":
+				if _, found := ids[cell]; !found {
+					ids[cell] = len(ids) + 1
+				}
+				cell = fmt.Sprintf("#%d", ids[cell])
+			case strings.HasSuffix(title, " At"):
+				cell = "<timestamp>"
+			}
+			normalized.Rows[i][j] = cell
+		}
+	}
+	return normalized
+}
@@ -1,6 +1,7 @@
 package gorm
 
 import (
+	"errors"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	. "go-learn-sql/common"
@@ -9,20 +10,37 @@ import (
 	"time"
 )
 
+// gormDao wraps the connection pool, or an open transaction when handed out by
+// withTx; depth counts the savepoints nested inside that transaction. params
+// are the connection parameters the dao was opened with.
 type gormDao struct {
 	*gorm.DB
+	depth  int
+	params DbParams
 }
 
 //noinspection GoExportedFuncWithUnexportedType
 func Init() gormDao {
-	db, err := gorm.Open("postgres", DefaultConnectionString())
+	return InitWith(DefaultParams)
+}
+
+// InitWith connects to the database described by params.
+func InitWith(params DbParams) gormDao {
+	params, err := ApplyProfile(params)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := gorm.Open("postgres", ConnectionString(params))
 	if err != nil {
 		log.Fatal(err)
 	}
 	db.
 		// LogMode(true).
 		SingularTable(true)
-	return gormDao{db}
+	// Refuse updates and deletes without a WHERE clause, so that a zero-valued
+	// model cannot wipe a table by accident.
+	db = db.BlockGlobalUpdate(true)
+	return gormDao{DB: db, params: params}
 }
 
 func (dao gormDao) Shutdown() {
@@ -32,92 +50,45 @@ func (dao gormDao) Shutdown() {
 	}
 }
 
-func (dao gormDao) PrintDatabaseState() {
-	dao.printClients()
-	dao.printProducts()
-	dao.printCustomers()
-}
-func (dao gormDao) printClients() {
-	log.Printf("*** %-15s ***", "Clients")
-	var clients []Client
-	result := dao.Order("id").Find(&clients)
-	if result.Error != nil {
-		log.Fatal(result.Error)
+func (dao gormDao) Snapshot() (State, error) {
+	var state State
+	for _, client := range dao.ListClients(ListFilter{IncludeInactive: true}) {
+		state.Clients = append(state.Clients, NewClientRow(client))
 	}
-	log.Printf("%-3s | %-40s | %s | %-20s | %-20s", "ID", "Name", "Active", "Created At", "Updated At")
-	log.Println(strings.Repeat("-", 101))
-	for _, client := range clients {
-		log.Printf("%-3d | %-40s | %-6t | %20s | %20s",
-			client.Id,
-			client.Name,
-			client.Active,
-			client.CreatedAt.Format(time.RFC822),
-			client.UpdatedAt.Format(time.RFC822))
+	for _, product := range dao.ListProducts(ListFilter{IncludeInactive: true}) {
+		state.Products = append(state.Products, NewProductRow(product))
 	}
-	log.Printf("Total: %d row(s)", len(clients))
-}
-
-func (dao gormDao) printProducts() {
-	log.Printf("*** %-15s ***", "Products")
-	var products []Product
-	result := dao.Order("id").Find(&products)
-	if result.Error != nil {
-		log.Fatal(result.Error)
-	}
-	log.Printf("%-3s | %-40s | %s | %-20s | %-20s", "ID", "Name", "Active", "Created At", "Updated At")
-	log.Println(strings.Repeat("-", 101))
-	for _, product := range products {
-		log.Printf("%-3d | %-40s | %-6t | %20s | %20s",
-			product.Id,
-			product.Name,
-			product.Active,
-			product.CreatedAt.Format(time.RFC822),
-			product.UpdatedAt.Format(time.RFC822))
-	}
-	log.Printf("Total: %d row(s)", len(products))
-}
-
-func (dao gormDao) printCustomers() {
-	log.Printf("*** %-15s ***", "Customers")
-	log.Printf("%-3s | %-10s | %-20s | %-20s | %-40s | %-40s | %20s | %20s",
-		"ID",
-		"Code",
-		"First Name",
-		"Last Name",
-		"Email",
-		"Client",
-		"Created At",
-		"Updated At")
-	log.Println(strings.Repeat("-", 194))
+	// Customer.Client is only filled in when preloaded; without it every
+	// customer would show an empty client name.
 	var customers []Customer
-	result := dao.Preload("Products").Order("id").Find(&customers)
-	if result.Error != nil {
-		log.Fatal(result.Error)
+	if result := dao.Preload("Client").Order("id").Find(&customers); result.Error != nil {
+		return state, result.Error
 	}
 	for _, customer := range customers {
-		log.Printf("%-3d | %-10s | %-20s | %-20s | %-40s | %-40s | %20s | %20s",
-			customer.Id,
-			customer.Code,
-			customer.FirstName,
-			customer.LastName,
-			customer.EmailAddress,
-			customer.Client.Name,
-			customer.CreatedAt.Format(time.RFC822),
-			customer.UpdatedAt.Format(time.RFC822))
-	}
-	log.Printf("Total: %d row(s)", len(customers))
-	// Customer/Product relationship
-	log.Printf("*** %-15s ***", "Customer/Products")
-	log.Printf("%-10s | %-20s | %-20s | %-40s", "Code", "First Name", "Last Name", "Product")
-	log.Println(strings.Repeat("-", 99))
-	var rowCount int
-	for _, customer := range customers {
-		for _, product := range customer.Products {
-			rowCount++
-			log.Printf("%-10s | %-20s | %-20s | %-40s", customer.Code, customer.FirstName, customer.LastName, product.Name)
-		}
+		state.Customers = append(state.Customers, CustomerRow{
+			Id:           customer.Id,
+			ClientId:     customer.ClientId,
+			Code:         customer.Code,
+			FirstName:    customer.FirstName,
+			MiddleName:   customer.MiddleName,
+			LastName:     customer.LastName,
+			EmailAddress: customer.EmailAddress,
+			ClientName:   customer.Client.Name,
+			CreatedAt:    customer.CreatedAt,
+			UpdatedAt:    customer.UpdatedAt,
+		})
+	}
+	result := dao.Table("customer c").
+		Select("c.id AS customer_id, p.id AS product_id, c.code, c.first_name, c.last_name, p.name AS product").
+		Joins("INNER JOIN customer_product cp ON c.id = cp.customer_id").
+		Joins("INNER JOIN product p ON cp.product_id = p.id").
+		Where("c.deleted_at IS NULL AND p.deleted_at IS NULL").
+		Order("c.last_name, c.first_name, p.name").
+		Scan(&state.Links)
+	if result.Error != nil {
+		return state, result.Error
 	}
-	log.Printf("Total: %d row(s)", rowCount)
+	return state, nil
 }
 
 func (dao gormDao) InsertClient(name string) Client {
@@ -135,16 +106,28 @@ func (dao gormDao) InsertClient(name string) Client {
 
 func (dao gormDao) InsertCustomer(code, firstName string, lastName string, email string, client Client) Customer {
 	log.Println("Insert customer", firstName, lastName)
-	customer := Customer{
-		Code:         code,
-		FirstName:    firstName,
-		LastName:     lastName,
-		EmailAddress: email,
-		Client:       client,
-	}
-	result := dao.Create(&customer)
-	if result.Error != nil {
-		log.Fatal(result.Error)
+	var customer Customer
+	err := dao.inTx(func(tx gormDao) error {
+		locked, err := tx.lockClient(client.Id)
+		if err == ErrNotFound || err == nil && !locked.Active {
+			return ErrInactiveClient
+		}
+		if err != nil {
+			return err
+		}
+		// Only the id is taken from client: saving it along would write a
+		// stale copy of the client row back over newer changes.
+		customer = Customer{
+			Code:         code,
+			FirstName:    firstName,
+			LastName:     lastName,
+			EmailAddress: email,
+			ClientId:     client.Id,
+		}
+		return tx.Set("gorm:save_associations", false).Create(&customer).Error
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 	return customer
 }
@@ -152,7 +135,8 @@ func (dao gormDao) InsertCustomer(code, firstName string, lastName string, email
 func (dao gormDao) InsertProduct(name string) Product {
 	log.Println("Insert product", name)
 	product := Product{
-		Name: name,
+		Name:   name,
+		Active: true,
 	}
 	result := dao.Create(&product)
 	if result.Error != nil {
@@ -161,90 +145,782 @@ func (dao gormDao) InsertProduct(name string) Product {
 	return product
 }
 
-func (dao gormDao) UpdateCustomerName(customer Customer, newFullName string) {
+// bulkInsertBatchSize keeps each multi-row INSERT well under the 65535 bind
+// parameter limit of the Postgres protocol.
+const bulkInsertBatchSize = 1000
+
+// BulkInsertCustomers inserts the customers, which must carry their ClientId,
+// with one multi-row INSERT per batch and returns their ids in the same order.
+func (dao gormDao) BulkInsertCustomers(customers []Customer) ([]int64, error) {
+	log.Println("Bulk insert", len(customers), "customers")
+	if len(customers) == 0 {
+		return nil, nil
+	}
+	ids := make([]int64, 0, len(customers))
+	err := dao.inTx(func(tx gormDao) error {
+		clientIds := DistinctClientIds(customers)
+		var activeClients int
+		result := tx.Model(&Client{}).Where("id IN (?) AND active", clientIds).Count(&activeClients)
+		if result.Error != nil {
+			return result.Error
+		}
+		if activeClients != len(clientIds) {
+			return ErrInactiveClient
+		}
+		for start := 0; start < len(customers); start += bulkInsertBatchSize {
+			end := start + bulkInsertBatchSize
+			if end > len(customers) {
+				end = len(customers)
+			}
+			batchIds, err := tx.insertCustomerBatch(customers[start:end])
+			if err != nil {
+				return err
+			}
+			ids = append(ids, batchIds...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (dao gormDao) insertCustomerBatch(customers []Customer) ([]int64, error) {
+	if dao.isSQLite() {
+		return dao.insertCustomerRows(customers)
+	}
+	var values strings.Builder
+	args := make([]interface{}, 0, 6*len(customers))
+	for i, customer := range customers {
+		if i > 0 {
+			values.WriteString(", ")
+		}
+		values.WriteString("(?, ?, ?, ?, ?, ?)")
+		var middleName interface{}
+		if customer.MiddleName != "" {
+			middleName = customer.MiddleName
+		}
+		args = append(args, customer.ClientId, customer.Code,
+			customer.FirstName, middleName, customer.LastName, customer.EmailAddress)
+	}
+	// Postgres hands back the RETURNING rows of a multi-row INSERT in VALUES
+	// order, which is what lets the ids line up with the customers.
+	rows, err := dao.Raw(
+		`INSERT INTO customer (client_id, code, first_name, middle_name, last_name, email_address)
+		VALUES `+values.String()+`
+		RETURNING id`, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]int64, 0, len(customers))
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// UpsertCustomer inserts the customer, or updates the one with the same code
+// under the client. Rows that already hold these values are left alone, and a
+// soft-deleted match is brought back. Create with a gorm:insert_option could
+// add the ON CONFLICT clause, but it can neither insert through the check that
+// the client is active nor tell an insert from an update, so this is the same
+// statement sqlDao uses.
+func (dao gormDao) UpsertCustomer(code, firstName string, lastName string, email string, client Client) (Customer, UpsertResult, error) {
+	log.Println("Upsert customer", code, "for client", client.Id)
+	var upserted struct {
+		Customer
+		Inserted bool
+	}
+	result := dao.Raw(
+		`INSERT INTO customer (code, first_name, last_name, email_address, client_id)
+		SELECT ?, ?, ?, ?, id
+		FROM client
+		WHERE id = ? AND active AND deleted_at IS NULL
+		ON CONFLICT (client_id, code) DO UPDATE
+		SET first_name = EXCLUDED.first_name
+		  , last_name = EXCLUDED.last_name
+		  , email_address = EXCLUDED.email_address
+		  , deleted_at = NULL
+		  , version = customer.version + 1
+		  , updated_at = now()
+		WHERE (customer.first_name, customer.last_name, customer.email_address, customer.deleted_at IS NULL)
+		  IS DISTINCT FROM (EXCLUDED.first_name, EXCLUDED.last_name, EXCLUDED.email_address, TRUE)
+		RETURNING *, xmax = 0 AS inserted`,
+		code, firstName, lastName, email, client.Id).
+		Scan(&upserted)
+	switch {
+	case result.Error == nil && upserted.Inserted:
+		return upserted.Customer, Inserted, nil
+	case result.Error == nil:
+		return upserted.Customer, Updated, nil
+	case !result.RecordNotFound():
+		return upserted.Customer, Unchanged, result.Error
+	}
+	// Nothing came back: either the client may not take customers, or the row
+	// was already up to date.
+	if !dao.isActive(&Client{}, client.Id) {
+		return Customer{}, Unchanged, ErrInactiveClient
+	}
+	var customer Customer
+	result = dao.Where("client_id = ? AND code = ?", client.Id, code).First(&customer)
+	return customer, Unchanged, result.Error
+}
+
+func (dao gormDao) UpdateCustomerName(customer Customer, newFullName string) (Customer, error) {
 	log.Println("Update customer", customer.Id, "name to", newFullName)
 	newFirstName, newLastName, err := SplitFullName(newFullName)
 	if err != nil {
-		log.Fatal(err)
+		return customer, err
 	}
-	customer.FirstName = newFirstName
-	customer.LastName = newLastName
-	result := dao.Save(&customer)
-	if result.Error != nil {
-		log.Fatal(result.Error)
-	}
-	logAffectedRows("Update customer name", result)
+	return dao.PatchCustomer(customer, CustomerPatch{
+		FirstName: &newFirstName,
+		LastName:  &newLastName,
+	})
 }
 
-func (dao gormDao) UpdateProductName(product Product, newName string) {
+func (dao gormDao) UpdateProductName(product Product, newName string) (Product, error) {
 	log.Println("Update product", product.Id, "name to", newName)
-	product.Name = newName
-	result := dao.Save(&product)
-	if result.Error != nil {
-		log.Fatal(result.Error)
-	}
-	logAffectedRows("Update product name", result)
+	return dao.PatchProduct(product, ProductPatch{Name: &newName})
 }
 
-func (dao gormDao) UpdateCustomerEmailAndLinkToProduct(customer Customer, newEmail string, product Product) {
+func (dao gormDao) UpdateCustomerEmailAndLinkToProduct(customer Customer, newEmail string, product Product) (Customer, error) {
 	log.Println("Update customer", customer.Id, "email address to", newEmail)
-	customer.EmailAddress = newEmail
+	updated := customer
+	err := dao.inTx(func(tx gormDao) error {
+		err := tx.patch(&updated, "customer", customer.Id, customer.Version, CustomerPatch{EmailAddress: &newEmail}.Columns())
+		if err != nil {
+			return err
+		}
+		return tx.LinkCustomerToProduct(updated, product)
+	})
+	if err != nil {
+		return customer, err
+	}
+	return updated, nil
+}
+
+// LinkCustomerToProduct is a no-op when the link already exists.
+func (dao gormDao) LinkCustomerToProduct(customer Customer, product Product) error {
 	log.Println("Link product", product.Id, "to customer", customer.Id)
-	customer.Products = append(customer.Products, product)
-	result := dao.Save(&customer)
+	var count int
+	result := dao.Model(&Customer{}).Where("id = ?", customer.Id).Count(&count)
 	if result.Error != nil {
-		log.Fatal(result.Error)
+		return result.Error
 	}
-	logAffectedRows("Update customer email and link to product", result)
+	if count == 0 {
+		return ErrNotFound
+	}
+	if !dao.isActive(&Product{}, product.Id) {
+		return ErrInactiveProduct
+	}
+	// The many2many join handler only inserts the link if it is not there yet.
+	return dao.Model(&customer).Association("Products").Append(product).Error
 }
 
-func (dao gormDao) DeleteClient(client Client) {
+func (dao gormDao) DeleteClient(client Client) error {
 	log.Println("Delete client", client.Id)
-	result := dao.Delete(&client)
-	if result.Error == nil {
-		log.Fatal("Delete client was not blocked by DB constraints")
+	return dao.inTx(func(tx gormDao) error {
+		if _, err := tx.lockClient(client.Id); err != nil {
+			return err
+		}
+		if tx.hasCustomers(client.Id) {
+			return ErrClientHasCustomers
+		}
+		result := tx.Delete(&client)
+		if result.Error != nil {
+			return result.Error
+		}
+		logAffectedRows("Delete client", result)
+		return checkFound(result)
+	})
+}
+
+// lockClient reads the live client with the given id and locks its row until
+// the transaction ends. InsertCustomer and DeleteClient both take the lock, so
+// that neither acts on a check the other has made stale in the meantime.
+// SQLite has no FOR UPDATE, but it only lets one writer at a time into the
+// database anyway.
+func (tx gormDao) lockClient(id int64) (Client, error) {
+	var client Client
+	query := tx.DB
+	if !tx.isSQLite() {
+		query = query.Set("gorm:query_option", "FOR UPDATE")
 	}
-	// log.Println(result.Error)
-	log.Println("Delete client was blocked by DB contraints, as expected")
+	result := query.Where("id = ?", id).First(&client)
+	if result.RecordNotFound() {
+		return client, ErrNotFound
+	}
+	return client, result.Error
 }
 
-func (dao gormDao) UpdateClientName(client Client, newName string) {
+// errDryRun rolls back the transaction of a dry run once it has been counted.
+var errDryRun = errors.New("Dry run")
+
+// DeleteClientCascade unlinks the client's live customers from their products,
+// then soft-deletes the customers and the client, all in one transaction. A
+// dry run does the same and rolls it back, so the counts are exact.
+func (dao gormDao) DeleteClientCascade(client Client, dryRun bool) (CascadeReport, error) {
+	log.Println("Delete client", client.Id, "with its customers, dry run:", dryRun)
+	report := CascadeReport{DryRun: dryRun}
+	err := dao.inTx(func(tx gormDao) error {
+		result := tx.Exec(
+			`DELETE FROM customer_product cp
+			USING customer c
+			WHERE c.id = cp.customer_id
+			  AND c.client_id = ?
+			  AND c.deleted_at IS NULL`, client.Id)
+		if result.Error != nil {
+			return result.Error
+		}
+		report.Links = result.RowsAffected
+		result = tx.Where("client_id = ?", client.Id).Delete(Customer{})
+		if result.Error != nil {
+			return result.Error
+		}
+		report.Customers = result.RowsAffected
+		result = tx.Delete(&client)
+		if result.Error != nil {
+			return result.Error
+		}
+		report.Clients = result.RowsAffected
+		if report.Clients == 0 {
+			return ErrNotFound
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		err = nil
+	}
+	if err != nil {
+		return CascadeReport{DryRun: dryRun}, err
+	}
+	log.Printf("%-20s: %d link(s), %d customer(s), %d client(s)", "Delete client cascade", report.Links, report.Customers, report.Clients)
+	return report, nil
+}
+
+// TransferCustomers moves live customers of fromClient over to toClient. Both
+// clients must be active, and none of the moved customer codes may already be
+// taken in toClient, soft-deleted customers included.
+func (dao gormDao) TransferCustomers(fromClient Client, toClient Client, customerIds []int64) (int64, error) {
+	log.Println("Transfer", len(customerIds), "customer(s) from client", fromClient.Id, "to client", toClient.Id)
+	if fromClient.Id == toClient.Id {
+		return 0, ErrSameClient
+	}
+	ids := DistinctIds(customerIds)
+	var moved int64
+	err := dao.inTx(func(tx gormDao) error {
+		// Locking both clients keeps them from being deactivated, and the
+		// target from gaining a colliding customer, until the move is done.
+		var clients []Client
+		result := tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("id IN (?) AND active", []int64{fromClient.Id, toClient.Id}).
+			Find(&clients)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(clients) != 2 {
+			return ErrInactiveClient
+		}
+		var found int
+		result = tx.Model(&Customer{}).Where("id IN (?) AND client_id = ?", ids, fromClient.Id).Count(&found)
+		if result.Error != nil {
+			return result.Error
+		}
+		if found != len(ids) {
+			return ErrNotFound
+		}
+		var codes []string
+		result = tx.Unscoped().
+			Table("customer t").
+			Joins("JOIN customer m ON m.code = t.code").
+			Where("m.id IN (?) AND t.client_id = ?", ids, toClient.Id).
+			Order("t.code").
+			Pluck("t.code", &codes)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(codes) > 0 {
+			return &CodeCollisionError{ClientId: toClient.Id, Codes: codes}
+		}
+		result = tx.Set("gorm:save_associations", false).
+			Model(&Customer{}).
+			Where("id IN (?)", ids).
+			Updates(map[string]interface{}{
+				"client_id": toClient.Id,
+				"version":   gorm.Expr("version + 1"),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		logAffectedRows("Transfer customers", result)
+		moved = result.RowsAffected
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
+
+// FindDuplicateCustomers pairs up live customers of client that share an email
+// address, share a name once it is normalized, or whose full names are at
+// least DuplicateSimilarity alike. Each pair is reported once, by its strongest
+// match.
+func (dao gormDao) FindDuplicateCustomers(client Client) ([]DuplicateCandidate, error) {
+	log.Println("Find duplicate customers of client", client.Id)
+	var pairs []struct {
+		CustomerId  int64
+		DuplicateId int64
+		Match       string
+		Similarity  float64
+	}
+	result := dao.Raw(
+		`SELECT a.id AS customer_id, b.id AS duplicate_id,
+			CASE
+				WHEN lower(a.email_address) = lower(b.email_address) THEN ?
+				WHEN `+normalizedName("a")+` = `+normalizedName("b")+` THEN ?
+				ELSE ?
+			END AS match,
+			similarity(a.first_name || ' ' || a.last_name, b.first_name || ' ' || b.last_name) AS similarity
+		FROM customer a
+		JOIN customer b ON b.client_id = a.client_id AND b.id > a.id
+		WHERE a.client_id = ?
+		  AND a.deleted_at IS NULL
+		  AND b.deleted_at IS NULL
+		  AND (lower(a.email_address) = lower(b.email_address)
+		    OR `+normalizedName("a")+` = `+normalizedName("b")+`
+		    OR similarity(a.first_name || ' ' || a.last_name, b.first_name || ' ' || b.last_name) >= ?)
+		ORDER BY a.id, b.id`,
+		string(MatchEmail), string(MatchName), string(MatchSimilarName), client.Id, DuplicateSimilarity).
+		Scan(&pairs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	var ids []int64
+	for _, pair := range pairs {
+		ids = append(ids, pair.CustomerId, pair.DuplicateId)
+	}
+	var customers []Customer
+	if result = dao.Where("id IN (?)", DistinctIds(ids)).Find(&customers); result.Error != nil {
+		return nil, result.Error
+	}
+	found := make(map[int64]Customer)
+	for _, customer := range customers {
+		found[customer.Id] = customer
+	}
+	candidates := make([]DuplicateCandidate, len(pairs))
+	for i, pair := range pairs {
+		candidates[i] = DuplicateCandidate{
+			Customer:   found[pair.CustomerId],
+			Duplicate:  found[pair.DuplicateId],
+			Match:      DuplicateMatch(pair.Match),
+			Similarity: pair.Similarity,
+		}
+	}
+	return candidates, nil
+}
+
+// normalizedName is the SQL expression for the first and last name of the
+// customer aliased as alias, lowercased and stripped of everything but letters.
+func normalizedName(alias string) string {
+	return "lower(regexp_replace(" + alias + ".first_name || " + alias + ".last_name, '[^[:alpha:]]', '', 'g'))"
+}
+
+// MergeCustomers folds duplicates into survivor: their product links move over
+// to the survivor, skipping products it is already linked to, and the
+// duplicates are deleted. The duplicates must be other live customers of the
+// survivor's client.
+func (dao gormDao) MergeCustomers(survivor Customer, duplicates []Customer) error {
+	ids := make([]int64, len(duplicates))
+	for i, duplicate := range duplicates {
+		ids[i] = duplicate.Id
+	}
+	ids = DistinctIds(ids)
+	log.Println("Merge", len(ids), "customer(s) into customer", survivor.Id)
+	return dao.inTx(func(tx gormDao) error {
+		// Locking the survivor and the duplicates keeps them from being
+		// deleted or transferred while their links move.
+		var locked []int64
+		result := tx.Set("gorm:query_option", "FOR UPDATE").
+			Table("customer d").
+			Joins("JOIN customer s ON s.client_id = d.client_id").
+			Where("d.id IN (?) AND d.id <> s.id AND s.id = ?", ids, survivor.Id).
+			Where("d.deleted_at IS NULL AND s.deleted_at IS NULL").
+			Pluck("d.id", &locked)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(locked) != len(ids) {
+			return ErrInvalidMerge
+		}
+		result = tx.Exec(
+			`INSERT INTO customer_product (customer_id, product_id)
+			SELECT DISTINCT ?::bigint, cp.product_id
+			FROM customer_product cp
+			WHERE cp.customer_id IN (?)
+			  AND NOT EXISTS (
+				SELECT 1 FROM customer_product s
+				WHERE s.customer_id = ? AND s.product_id = cp.product_id)`, survivor.Id, ids, survivor.Id)
+		if result.Error != nil {
+			return result.Error
+		}
+		logAffectedRows("Move customer links", result)
+		result = tx.Exec("DELETE FROM customer_product WHERE customer_id IN (?)", ids)
+		if result.Error != nil {
+			return result.Error
+		}
+		logAffectedRows("Delete merged links", result)
+		result = tx.Where("id IN (?)", ids).Delete(&Customer{})
+		if result.Error != nil {
+			return result.Error
+		}
+		logAffectedRows("Delete merged", result)
+		return nil
+	})
+}
+
+func (dao gormDao) UpdateClientName(client Client, newName string) (Client, error) {
 	log.Println("Update client", client.Id, "name to", newName)
-	client.Name = newName
-	result := dao.Save(&client)
+	return dao.PatchClient(client, ClientPatch{Name: &newName})
+}
+
+func (dao gormDao) PatchCustomer(customer Customer, patch CustomerPatch) (Customer, error) {
+	log.Println("Patch customer", customer.Id)
+	updated := customer
+	if err := dao.patch(&updated, "customer", customer.Id, customer.Version, patch.Columns()); err != nil {
+		return customer, err
+	}
+	return updated, nil
+}
+
+func (dao gormDao) PatchProduct(product Product, patch ProductPatch) (Product, error) {
+	log.Println("Patch product", product.Id)
+	updated := product
+	if err := dao.patch(&updated, "product", product.Id, product.Version, patch.Columns()); err != nil {
+		return product, err
+	}
+	return updated, nil
+}
+
+func (dao gormDao) PatchClient(client Client, patch ClientPatch) (Client, error) {
+	log.Println("Patch client", client.Id)
+	updated := client
+	if err := dao.patch(&updated, "client", client.Id, client.Version, patch.Columns()); err != nil {
+		return client, err
+	}
+	return updated, nil
+}
+
+// patch applies a version-guarded update and reloads the model, so callers
+// see the new version and UpdatedAt. An empty patch only reloads.
+func (dao gormDao) patch(model interface{}, table string, id int64, version int64, columns map[string]interface{}) error {
+	// No row has a zero id, and gorm would leave the id out of the update.
+	if id == 0 {
+		return ErrNotFound
+	}
+	if len(columns) > 0 {
+		result := dao.updateVersioned(model, id, version, columns)
+		if result.Error != nil {
+			return result.Error
+		}
+		logAffectedRows("Patch "+table, result)
+		if result.RowsAffected == 0 {
+			return dao.missingOrConflict(table, id, version)
+		}
+	}
+	return dao.reload(model, id)
+}
+
+// updateVersioned applies the column changes to the row with the given id only
+// if it is still at the given version, bumping the version along with them.
+// Unlike Save it never touches columns that are not listed, nor the associated
+// records. The id is spelled out because gorm only adds the primary key of a
+// model that has a non-zero one.
+func (dao gormDao) updateVersioned(model interface{}, id int64, version int64, columns map[string]interface{}) *gorm.DB {
+	columns["version"] = version + 1
+	return dao.Set("gorm:save_associations", false).
+		Model(model).
+		Where("id = ? AND version = ?", id, version).
+		Updates(columns)
+}
+
+// missingOrConflict explains why a version-guarded update matched no rows:
+// either the row is gone or it moved on to another version.
+func (dao gormDao) missingOrConflict(table string, id int64, version int64) error {
+	var count int
+	result := dao.Table(table).Where("id = ? AND deleted_at IS NULL", id).Count(&count)
+	if result.Error != nil {
+		return result.Error
+	}
+	if count > 0 {
+		return &ConflictError{Table: table, Id: id, Version: version}
+	}
+	return ErrNotFound
+}
+
+// reload reads the live row back into model.
+func (dao gormDao) reload(model interface{}, id int64) error {
+	result := dao.First(model, id)
+	if result.RecordNotFound() {
+		return ErrNotFound
+	}
+	return result.Error
+}
+
+func (dao gormDao) ActivateClient(client Client) (Client, error) {
+	log.Println("Activate client", client.Id)
+	err := dao.setActive(&client, client.Id, true)
+	return client, err
+}
+
+func (dao gormDao) DeactivateClient(client Client) (Client, error) {
+	log.Println("Deactivate client", client.Id)
+	err := dao.setActive(&client, client.Id, false)
+	return client, err
+}
+
+func (dao gormDao) ActivateProduct(product Product) (Product, error) {
+	log.Println("Activate product", product.Id)
+	err := dao.setActive(&product, product.Id, true)
+	return product, err
+}
+
+func (dao gormDao) DeactivateProduct(product Product) (Product, error) {
+	log.Println("Deactivate product", product.Id)
+	err := dao.setActive(&product, product.Id, false)
+	return product, err
+}
+
+// setActive flips the active flag of a client or product, leaving every other
+// column alone, and reloads the model.
+func (dao gormDao) setActive(model interface{}, id int64, active bool) error {
+	// The explicit id keeps a zero-valued model from turning this into an
+	// update of the whole table.
+	result := dao.Set("gorm:save_associations", false).Model(model).Where("id = ?", id).Updates(map[string]interface{}{
+		"active":  active,
+		"version": gorm.Expr("version + 1"),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if err := checkFound(result); err != nil {
+		return err
+	}
+	return dao.reload(model, id)
+}
+
+// isActive reports whether the client or product with the given id exists and
+// is active.
+func (dao gormDao) isActive(model interface{}, id int64) bool {
+	var count int
+	result := dao.Model(model).Where("id = ? AND active", id).Count(&count)
+	if result.Error != nil {
+		log.Fatal(result.Error)
+	}
+	return count > 0
+}
+
+func (dao gormDao) ListClients(filter ListFilter) []Client {
+	var clients []Client
+	query := dao.Order("id")
+	if !filter.IncludeInactive {
+		query = query.Where("active")
+	}
+	result := query.Find(&clients)
+	if result.Error != nil {
+		log.Fatal(result.Error)
+	}
+	return clients
+}
+
+func (dao gormDao) ListProducts(filter ListFilter) []Product {
+	var products []Product
+	query := dao.Order("id")
+	if !filter.IncludeInactive {
+		query = query.Where("active")
+	}
+	result := query.Find(&products)
 	if result.Error != nil {
 		log.Fatal(result.Error)
 	}
-	logAffectedRows("Update client name", result)
+	return products
 }
 
-func (dao gormDao) DeleteCustomer(customer Customer) {
+func (dao gormDao) DeleteCustomer(customer Customer) error {
 	log.Println("Delete customer", customer.Id)
 	result := dao.Delete(&customer)
 	if result.Error != nil {
-		log.Fatal(result.Error)
+		return result.Error
 	}
 	logAffectedRows("Delete customer", result)
+	return checkFound(result)
 }
 
-func (dao gormDao) DeleteAllCustomers() {
+func (dao gormDao) DeleteAllCustomers(confirm string) (int64, error) {
 	log.Println("Delete all customers")
-	result := dao.Delete(Customer{})
-	logAffectedRows("Delete all customers", result)
+	return dao.deleteAll(&Customer{}, "customer", confirm)
 }
 
-func (dao gormDao) DeleteAllProducts() {
+func (dao gormDao) DeleteAllProducts(confirm string) (int64, error) {
 	log.Println("Delete all products")
-	result := dao.Delete(Product{})
-	logAffectedRows("Delete all products", result)
+	return dao.deleteAll(&Product{}, "product", confirm)
 }
 
-func (dao gormDao) DeleteAllClients() {
+func (dao gormDao) DeleteAllClients(confirm string) (int64, error) {
 	log.Println("Delete all clients")
-	result := dao.Delete(Client{})
-	logAffectedRows("Delete all clients", result)
+	if dao.hasCustomers(0) {
+		return 0, ErrClientHasCustomers
+	}
+	return dao.deleteAll(&Client{}, "client", confirm)
+}
+
+// deleteAll soft-deletes every live row of the model's table once
+// CheckMassDelete allows it, logging how many rows are about to go first. The
+// condition is spelled out because BlockGlobalUpdate refuses a bare Delete.
+func (dao gormDao) deleteAll(model interface{}, table string, confirm string) (int64, error) {
+	var count int
+	if result := dao.Model(model).Count(&count); result.Error != nil {
+		return 0, result.Error
+	}
+	log.Printf("%-20s: %d row(s) to delete", "Delete all "+table+"s", count)
+	if err := CheckMassDelete(dao.params, confirm); err != nil {
+		return 0, err
+	}
+	result := dao.Where("deleted_at IS NULL").Delete(model)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	logAffectedRows("Delete all "+table+"s", result)
+	return result.RowsAffected, nil
+}
+
+// hasCustomers reports whether the client has any live customers; a zero id
+// checks across all clients.
+func (dao gormDao) hasCustomers(clientId int64) bool {
+	var count int
+	query := dao.Model(&Customer{})
+	if clientId != 0 {
+		query = query.Where("client_id = ?", clientId)
+	}
+	result := query.Count(&count)
+	if result.Error != nil {
+		log.Fatal(result.Error)
+	}
+	return count > 0
+}
+
+func (dao gormDao) RestoreCustomer(customer Customer) (Customer, error) {
+	log.Println("Restore customer", customer.Id)
+	err := dao.restore(&customer, customer.Id,
+		"EXISTS (SELECT 1 FROM client WHERE client.id = customer.client_id AND client.deleted_at IS NULL)")
+	return customer, err
+}
+
+func (dao gormDao) RestoreProduct(product Product) (Product, error) {
+	log.Println("Restore product", product.Id)
+	err := dao.restore(&product, product.Id, "TRUE")
+	return product, err
+}
+
+func (dao gormDao) RestoreClient(client Client) (Client, error) {
+	log.Println("Restore client", client.Id)
+	err := dao.restore(&client, client.Id, "TRUE")
+	return client, err
+}
+
+// restore clears DeletedAt on the soft-deleted row with the given id if it also
+// meets condition, bumping its version like any other update, then reloads the
+// model. As in updateVersioned, the id is spelled out so that a zero id does
+// not restore the whole table.
+func (dao gormDao) restore(model interface{}, id int64, condition string) error {
+	result := dao.Unscoped().
+		Set("gorm:save_associations", false).
+		Model(model).
+		Where("id = ? AND deleted_at IS NOT NULL", id).
+		Where(condition).
+		Updates(map[string]interface{}{
+			"deleted_at": gorm.Expr("NULL"),
+			"version":    gorm.Expr("version + 1"),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	logAffectedRows("Restore", result)
+	if err := checkFound(result); err != nil {
+		return err
+	}
+	return dao.reload(model, id)
+}
+
+// Purge hard-deletes the records soft-deleted more than olderThan ago, along
+// with their links, and returns how many records went; links are not counted.
+// As in sqlDao, the cutoff is worked out by the database clock.
+func (dao gormDao) Purge(olderThan time.Duration) (int64, error) {
+	log.Println("Purge records deleted more than", olderThan, "ago")
+	cutoff := gorm.Expr("now() - make_interval(secs => ?)", olderThan.Seconds())
+	var purged int64
+	err := dao.inTx(func(tx gormDao) error {
+		purged = 0
+		result := tx.Exec(
+			`DELETE FROM customer_product cp
+			USING customer c, product p
+			WHERE c.id = cp.customer_id
+			  AND p.id = cp.product_id
+			  AND (c.deleted_at < ? OR p.deleted_at < ?)`, cutoff, cutoff)
+		if result.Error != nil {
+			return result.Error
+		}
+		logAffectedRows("Purge links", result)
+		result = tx.Unscoped().Where("deleted_at < ?", cutoff).Delete(Customer{})
+		if result.Error != nil {
+			return result.Error
+		}
+		logAffectedRows("Purge customer", result)
+		purged += result.RowsAffected
+		result = tx.Unscoped().Where("deleted_at < ?", cutoff).Delete(Product{})
+		if result.Error != nil {
+			return result.Error
+		}
+		logAffectedRows("Purge product", result)
+		purged += result.RowsAffected
+		result = tx.Unscoped().
+			Where("deleted_at < ?", cutoff).
+			Where("NOT EXISTS (SELECT 1 FROM customer WHERE customer.client_id = client.id)").
+			Delete(Client{})
+		if result.Error != nil {
+			return result.Error
+		}
+		logAffectedRows("Purge client", result)
+		purged += result.RowsAffected
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
 }
 
 func logAffectedRows(prefix string, db *gorm.DB) {
 	log.Printf("%-20s: %d row(s) affected", prefix, db.RowsAffected)
 }
+
+// checkFound turns a single-row update or delete that matched nothing into
+// ErrNotFound.
+func checkFound(db *gorm.DB) error {
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
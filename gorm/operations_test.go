@@ -0,0 +1,93 @@
+package gorm
+
+import (
+	. "go-learn-sql/common"
+	"go-learn-sql/common/dbtest"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeleteAllRefusedInProtectedProfile(t *testing.T) {
+	params := dbtest.Params(t)
+	t.Setenv(ProtectedEnv, "true")
+	dao := InitWith(params)
+	defer dao.Shutdown()
+	if !dao.params.Protected {
+		t.Fatalf("%s=true did not open a protected dao", ProtectedEnv)
+	}
+	if _, err := dao.DeleteAllCustomers(MassDeleteToken); err != ErrMassDeleteProtected {
+		t.Errorf("DeleteAllCustomers() = %v, want %v", err, ErrMassDeleteProtected)
+	}
+}
+
+// TestSetActiveOnlyTouchesItsRow runs with the global update block lifted, to
+// show that setActive does not lean on it.
+func TestSetActiveOnlyTouchesItsRow(t *testing.T) {
+	dao := InitSQLite(filepath.Join(t.TempDir(), "active.db"))
+	defer dao.Shutdown()
+	dao.DB = dao.BlockGlobalUpdate(false)
+	first := dao.InsertClient("First Client")
+	second := dao.InsertClient("Second Client")
+	if _, err := dao.DeactivateClient(Client{}); err != ErrNotFound {
+		t.Errorf("DeactivateClient() on a zero-valued client = %v, want %v", err, ErrNotFound)
+	}
+	if _, err := dao.DeactivateClient(first); err != nil {
+		t.Fatal(err)
+	}
+	active := dao.ListClients(ListFilter{})
+	if len(active) != 1 || active[0].Id != second.Id {
+		t.Errorf("active clients = %+v, want only client %d", active, second.Id)
+	}
+}
+
+// TestPatchOfZeroIdTouchesNoRow patches a bare stub with no id at the version
+// every new row starts at, with the global update block lifted.
+func TestPatchOfZeroIdTouchesNoRow(t *testing.T) {
+	dao := InitSQLite(filepath.Join(t.TempDir(), "patch.db"))
+	defer dao.Shutdown()
+	dao.DB = dao.BlockGlobalUpdate(false)
+	dao.InsertClient("First Client")
+	dao.InsertClient("Second Client")
+	if _, err := dao.PatchClient(NewClient(0), ClientPatch{Name: String("Renamed Client")}); err != ErrNotFound {
+		t.Errorf("PatchClient() on a zero-id stub = %v, want %v", err, ErrNotFound)
+	}
+	for _, client := range dao.ListClients(ListFilter{}) {
+		if client.Name == "Renamed Client" || client.Version != 0 {
+			t.Errorf("client %d was patched to %+v", client.Id, client)
+		}
+	}
+}
+
+func TestRestoreOfZeroIdTouchesNoRow(t *testing.T) {
+	dao := InitSQLite(filepath.Join(t.TempDir(), "restore.db"))
+	defer dao.Shutdown()
+	for _, name := range []string{"First Client", "Second Client"} {
+		if err := dao.DeleteClient(dao.InsertClient(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := dao.RestoreClient(NewClient(0)); err != ErrNotFound {
+		t.Errorf("RestoreClient() on a zero-id stub = %v, want %v", err, ErrNotFound)
+	}
+	if restored := dao.ListClients(ListFilter{IncludeInactive: true}); len(restored) > 0 {
+		t.Errorf("clients restored through a zero-id stub: %+v", restored)
+	}
+}
+
+func TestInsertCustomerLeavesClientAlone(t *testing.T) {
+	dao := InitSQLite(filepath.Join(t.TempDir(), "customer.db"))
+	defer dao.Shutdown()
+	stale := dao.InsertClient("Old Name")
+	renamed, err := dao.UpdateClientName(stale, "New Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	customer := dao.InsertCustomer("C-1", "Ada", "Lovelace", "ada@example.com", stale)
+	if customer.ClientId != stale.Id {
+		t.Errorf("customer.ClientId = %d, want %d", customer.ClientId, stale.Id)
+	}
+	clients := dao.ListClients(ListFilter{})
+	if len(clients) != 1 || clients[0].Name != renamed.Name || clients[0].Version != renamed.Version {
+		t.Errorf("clients after the insert = %+v, want %+v", clients, renamed)
+	}
+}
@@ -0,0 +1,55 @@
+package gorm
+
+import (
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	. "go-learn-sql/common"
+	"log"
+)
+
+// InitSQLite opens the SQLite database file at path, creating it and any
+// missing table. Only the operations that a copy goes through, inserts,
+// links, deactivations, snapshots and transactions, work on SQLite; the rest
+// of the dao relies on Postgres.
+func InitSQLite(path string) gormDao {
+	params, err := ApplyProfile(DbParams{Database: path})
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := gorm.Open("sqlite3", path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.SingularTable(true)
+	// Migrating Customer also creates the customer_product join table.
+	if err = db.AutoMigrate(&Client{}, &Product{}, &Customer{}).Error; err != nil {
+		log.Fatal(err)
+	}
+	db = db.BlockGlobalUpdate(true)
+	return gormDao{DB: db, params: params}
+}
+
+func (dao gormDao) isSQLite() bool {
+	return dao.Dialect().GetName() == "sqlite3"
+}
+
+// insertCustomerRows inserts the customers one row at a time, for databases
+// that cannot return the ids of a multi-row INSERT.
+func (dao gormDao) insertCustomerRows(customers []Customer) ([]int64, error) {
+	ids := make([]int64, len(customers))
+	for i, customer := range customers {
+		row := Customer{
+			ClientId:     customer.ClientId,
+			Code:         customer.Code,
+			FirstName:    customer.FirstName,
+			MiddleName:   customer.MiddleName,
+			LastName:     customer.LastName,
+			EmailAddress: customer.EmailAddress,
+		}
+		if err := dao.Set("gorm:save_associations", false).Create(&row).Error; err != nil {
+			return nil, err
+		}
+		ids[i] = row.Id
+	}
+	return ids, nil
+}
@@ -0,0 +1,117 @@
+package gorm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	. "go-learn-sql/common"
+	"log"
+)
+
+func (dao gormDao) WithTx(options TxOptions, fn func(tx Dao) error) error {
+	return dao.withTx(options, func(tx gormDao) error {
+		return fn(tx)
+	})
+}
+
+// inTx is withTx with the default options and retry policy, for the
+// operations that need several statements to succeed or fail together.
+func (dao gormDao) inTx(fn func(tx gormDao) error) error {
+	return dao.withTx(TxOptions{Retry: DefaultRetryPolicy}, fn)
+}
+
+// withTx runs fn against a dao bound to a transaction, committing if fn
+// returns nil and rolling back otherwise, and retries the lot as the options'
+// policy allows. gorm.DB.Transaction takes no options, hence the hand-rolled
+// commit and rollback. A dao that is already in a transaction runs fn under a
+// savepoint instead, so that a failing fn only undoes its own work.
+func (dao gormDao) withTx(options TxOptions, fn func(tx gormDao) error) error {
+	if dao.inTransaction() {
+		return dao.withSavepoint(fn)
+	}
+	return options.Retry.Run(onRetry(options), func() error {
+		db := dao.BeginTx(context.Background(), &sql.TxOptions{
+			Isolation: options.Isolation,
+			ReadOnly:  options.ReadOnly,
+		})
+		if db.Error != nil {
+			return db.Error
+		}
+		// gorm.DB.Transaction rolls back when fn panics, and so does this,
+		// before the panic carries on.
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				db.Rollback()
+				panic(recovered)
+			}
+		}()
+		if err := fn(gormDao{DB: db, params: dao.params}); err != nil {
+			db.Rollback()
+			return err
+		}
+		return db.Commit().Error
+	})
+}
+
+// withSavepoint names the savepoint after the nesting depth, so that inner
+// savepoints never shadow the ones they are nested in.
+func (dao gormDao) withSavepoint(fn func(tx gormDao) error) error {
+	nested := dao
+	nested.depth++
+	name := fmt.Sprintf("sp_%d", nested.depth)
+	if err := dao.Exec("SAVEPOINT " + name).Error; err != nil {
+		return err
+	}
+	if err := fn(nested); err != nil {
+		if rollbackErr := dao.Exec("ROLLBACK TO SAVEPOINT " + name).Error; rollbackErr != nil {
+			log.Println("Rollback to savepoint", name, "failed:", rollbackErr)
+		}
+		return err
+	}
+	return dao.Exec("RELEASE SAVEPOINT " + name).Error
+}
+
+// onRetry logs every retry before passing it on to the caller's hook.
+func onRetry(options TxOptions) func(attempt int, err error) {
+	return func(attempt int, err error) {
+		log.Println("Retrying transaction after attempt", attempt, "failed:", err)
+		if options.OnRetry != nil {
+			options.OnRetry(attempt, err)
+		}
+	}
+}
+
+func (dao gormDao) inTransaction() bool {
+	_, ok := dao.CommonDB().(*sql.Tx)
+	return ok
+}
+
+// errBatchFailed rolls back an all-or-nothing batch with a failed item; the
+// item's own error is in the report.
+var errBatchFailed = errors.New("Batch failed")
+
+func (dao gormDao) RunBatch(operations []Operation, mode BatchMode) (BatchReport, error) {
+	log.Println("Run batch of", len(operations), "operation(s)")
+	var report BatchReport
+	attempts := 0
+	err := dao.inTx(func(tx gormDao) error {
+		attempts++
+		report = ApplyBatch(tx, operations, mode)
+		if !report.Committed {
+			return report.RollbackError(errBatchFailed)
+		}
+		return nil
+	})
+	report.Attempts = attempts
+	if err == errBatchFailed {
+		err = nil
+	}
+	// The last attempt may have run every item and still failed to commit,
+	// or run out of retries.
+	if err != nil {
+		report.Committed = false
+	}
+	log.Printf("Batch: %d of %d operation(s) failed, committed: %t", report.Failed(), len(operations), report.Committed)
+	return report, err
+}
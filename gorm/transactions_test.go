@@ -0,0 +1,31 @@
+package gorm
+
+import (
+	. "go-learn-sql/common"
+	"path/filepath"
+	"testing"
+)
+
+// TestWithTxRollsBackOnPanic runs on SQLite, which locks the whole database
+// for a writing transaction: if the panicking one were left open, the insert
+// after it would fail on the lock.
+func TestWithTxRollsBackOnPanic(t *testing.T) {
+	dao := InitSQLite(filepath.Join(t.TempDir(), "tx.db"))
+	defer dao.Shutdown()
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != "boom" {
+				t.Errorf("recovered %v, want the panic from fn", recovered)
+			}
+		}()
+		dao.WithTx(TxOptions{}, func(tx Dao) error {
+			tx.InsertClient("Panicking Client")
+			panic("boom")
+		})
+	}()
+	dao.InsertClient("Next Client")
+	clients := dao.ListClients(ListFilter{IncludeInactive: true})
+	if len(clients) != 1 || clients[0].Name != "Next Client" {
+		t.Errorf("clients after the panic = %+v, want only Next Client", clients)
+	}
+}
@@ -1,24 +1,13 @@
 package main
 
-// Seed dal
-//   1. Insert 2 clients
-//   2. Insert 8 customers
-//   3. Insert 3 products
-//   4. Link all customers to 1 or 2 random products
-// Find and update some dal
-//   1. Find customer and update name
-//   2. Find product and update name
-//   3. Find customer, update email, and create link to new product (transaction)
-//   4. Find client and delete it (should produce error)
-//   5. Find client and update name
-//   6. Find customer and delete it
-// Cleanup dal
-//   1. Delete customers (should delete customer/product links too)
-//   2. Delete products
-//   3. Delete clients
-
 import (
+	"flag"
 	. "go-learn-sql/common"
+	"go-learn-sql/common/table"
+	"go-learn-sql/fixture"
+	"go-learn-sql/scenario"
+	"log"
+	"os"
 	/// Experiment with database access using only Go's database/dal package
 	/// Using documentation from http://go-database-sql.org/
 	// dal "go-learn-sql/sql"
@@ -36,41 +25,39 @@ import (
 	// dal "go-learn-sql/gopg"
 )
 
+var scenarioFile = flag.String("scenario", "scenarios/basketball.yaml", "YAML or JSON scenario file to run")
+var format = flag.String("format", string(FormatText), "output format of the database state: text, json, csv, markdown or html")
+var diffSteps = flag.Bool("diff", false, "report what each scenario step changed in the database")
+var exportPath = flag.String("export", "", "export the database contents to this .json file, or CSV directory, instead of running the scenario")
+var importPath = flag.String("import", "", "import a fixture exported with -export into the empty database instead of running the scenario")
+
 func main() {
+	flag.Parse()
+	stateFormat, err := ParseFormat(*format)
+	check(err)
+	tableOptions := table.TerminalOptions(os.Stdout)
 	dao := dal.Init()
 	defer dao.Shutdown()
 
-	clients := [2]Client{
-		dao.InsertClient("Los Angeles Lakers"),
-		dao.InsertClient("Boston Celtics"),
-	}
-	customers := [8]Customer{
-		dao.InsertCustomer("123", "Kobe", "Bryant", "kbryant8@lakers.com", clients[0]),
-		dao.InsertCustomer("234", "Shaquille", "O'Neal", "soneal@lakers.com", clients[0]),
-		dao.InsertCustomer("345", "Magic", "Johnson", "mjohnson@lakers.com", clients[0]),
-		dao.InsertCustomer("456", "Kareem", "Abdul-Jabbar", "kabduljabbar@lakers.com", clients[0]),
-		dao.InsertCustomer("567", "Jerry", "West", "jwest@lakers.com", clients[0]),
-		dao.InsertCustomer("678", "Bill", "Russell", "brussel@celtics.com", clients[1]),
-		dao.InsertCustomer("789", "Larry", "Bird", "lbird@celtics.com", clients[1]),
-		dao.InsertCustomer("890", "Paul", "Pierce", "ppierce@celtics.com", clients[1]),
+	if *exportPath != "" {
+		contents, err := fixture.Export(dao)
+		check(err)
+		check(fixture.Save(*exportPath, contents))
+		return
 	}
-	products := [3]Product{
-		dao.InsertProduct("Super Personal Resolution Service"),
-		dao.InsertProduct("Fantastic Identity Monitoring"),
-		dao.InsertProduct("Watching Some Other Stuff"),
+	if *importPath != "" {
+		contents, err := fixture.Load(*importPath)
+		check(err)
+		check(fixture.Import(dao, contents, nil))
+		return
 	}
-	dao.PrintDatabaseState()
-
-	dao.UpdateCustomerName(customers[3], "Lew Alcindor")
-	dao.UpdateProductName(products[2], "Stupendous Cyber Monitoring")
-	dao.UpdateCustomerEmailAndLinkToProduct(customers[4], "jwest@clippers.com", products[1])
-	dao.DeleteClient(clients[1])
-	dao.UpdateClientName(clients[1], "Evil Empire")
-	dao.DeleteCustomer(customers[7])
-	dao.PrintDatabaseState()
+	steps, err := scenario.Load(*scenarioFile)
+	check(err)
+	check(scenario.Run(dao, steps, newConsoleObserver(dao, stateFormat, tableOptions)))
+}
 
-	dao.DeleteAllCustomers()
-	dao.DeleteAllProducts()
-	dao.DeleteAllClients()
-	dao.PrintDatabaseState()
+func check(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
 }
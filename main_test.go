@@ -0,0 +1,14 @@
+package main
+
+import (
+	. "go-learn-sql/common"
+	gormdal "go-learn-sql/gorm"
+	sqldal "go-learn-sql/sql"
+)
+
+// backends opens a dao of each backend, for the tests and benchmarks that
+// run against both.
+var backends = map[string]func(params DbParams) Dao{
+	"sql":  func(params DbParams) Dao { return sqldal.InitWith(params) },
+	"gorm": func(params DbParams) Dao { return gormdal.InitWith(params) },
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	. "go-learn-sql/common"
+	"go-learn-sql/common/table"
+	"log"
+	"os"
+)
+
+// consoleObserver prints the database state at every phase and, with -diff,
+// what each step changed, by diffing a snapshot taken after the step against
+// the one taken after the step before.
+type consoleObserver struct {
+	dao        Dao
+	format     Format
+	diffFormat Format
+	options    table.Options
+	last       State
+}
+
+func newConsoleObserver(dao Dao, format Format, options table.Options) *consoleObserver {
+	observer := &consoleObserver{dao: dao, format: format, diffFormat: FormatText, options: options}
+	if format == FormatJSON {
+		observer.diffFormat = FormatJSON
+	}
+	if *diffSteps {
+		var err error
+		observer.last, err = dao.Snapshot()
+		check(err)
+	}
+	return observer
+}
+
+func (observer *consoleObserver) Step(name string) {
+	if !*diffSteps {
+		return
+	}
+	state, err := observer.dao.Snapshot()
+	check(err)
+	log.Println("Changes made by step:", name)
+	check(RenderDiff(os.Stdout, Diff(observer.last, state), observer.diffFormat))
+	observer.last = state
+}
+
+func (observer *consoleObserver) Phase(name string) {
+	log.Println("Database state:", name)
+	check(PrintDatabaseState(os.Stdout, observer.dao, observer.format, observer.options))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	. "go-learn-sql/common"
+	"go-learn-sql/common/dbtest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestPatchPreservesUntouchedColumns checks that the Patch* methods of each
+// backend only change the patched column, along with version and updated_at,
+// even when handed a bare stub of the record.
+func TestPatchPreservesUntouchedColumns(t *testing.T) {
+	params := dbtest.Params(t)
+	for _, backend := range []string{"sql", "gorm"} {
+		t.Run(backend, func(t *testing.T) {
+			dao := backends[backend](params)
+			defer dao.Shutdown()
+			checkPatches(t, params, dao)
+		})
+	}
+}
+
+func checkPatches(t *testing.T, params DbParams, dao Dao) {
+	client := dao.InsertClient("Patch Test Client")
+	t.Cleanup(func() { dbtest.PurgeClient(t, params, client.Id) })
+	product := dao.InsertProduct("Patch Test Product")
+	t.Cleanup(func() { dbtest.PurgeProduct(t, params, product.Id) })
+	customer := dao.InsertCustomer("PATCH-1", "Ada", "Lovelace", "ada@example.com", client)
+	db := dbtest.Open(t, params)
+
+	t.Run("customer", func(t *testing.T) {
+		before := readRow(t, db, "customer", customer.Id)
+		stub := NewCustomer(customer.Id)
+		stub.Version = before["version"].(int64)
+		patched, err := dao.PatchCustomer(stub, CustomerPatch{EmailAddress: String("ada@lovelace.example")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := checkPatched(t, db, "customer", before, "email_address", "ada@lovelace.example")
+		if patched.Code != "PATCH-1" || patched.FirstName != "Ada" || patched.LastName != "Lovelace" || patched.ClientId != client.Id {
+			t.Errorf("PatchCustomer() returned %+v, which lost the unpatched fields", patched)
+		}
+		checkReturned(t, patched.UpdatableRecord, after)
+	})
+	t.Run("product", func(t *testing.T) {
+		before := readRow(t, db, "product", product.Id)
+		stub := NewProduct(product.Id)
+		stub.Version = before["version"].(int64)
+		patched, err := dao.PatchProduct(stub, ProductPatch{Name: String("Patched Test Product")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := checkPatched(t, db, "product", before, "name", "Patched Test Product")
+		if !patched.Active {
+			t.Errorf("PatchProduct() returned %+v, which lost the unpatched fields", patched)
+		}
+		checkReturned(t, patched.UpdatableRecord, after)
+	})
+	t.Run("client", func(t *testing.T) {
+		before := readRow(t, db, "client", client.Id)
+		stub := NewClient(client.Id)
+		stub.Version = before["version"].(int64)
+		patched, err := dao.PatchClient(stub, ClientPatch{Name: String("Patched Test Client")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := checkPatched(t, db, "client", before, "name", "Patched Test Client")
+		if !patched.Active {
+			t.Errorf("PatchClient() returned %+v, which lost the unpatched fields", patched)
+		}
+		checkReturned(t, patched.UpdatableRecord, after)
+	})
+	t.Run("stale version", func(t *testing.T) {
+		before := readRow(t, db, "client", client.Id)
+		stub := NewClient(client.Id)
+		stub.Version = before["version"].(int64) - 1
+		_, err := dao.PatchClient(stub, ClientPatch{Name: String("Stale Test Client")})
+		if _, conflict := err.(*ConflictError); !conflict {
+			t.Errorf("PatchClient() at a stale version = %v, want a *ConflictError", err)
+		}
+		if after := readRow(t, db, "client", client.Id); !reflect.DeepEqual(after, before) {
+			t.Errorf("stale patch changed the row from %v to %v", before, after)
+		}
+	})
+}
+
+// checkPatched reads the row back and checks that column now holds value,
+// that version went up by one and updated_at moved on, and that every other
+// column is as it was.
+func checkPatched(t *testing.T, db *sql.DB, table string, before map[string]interface{}, column string, value interface{}) map[string]interface{} {
+	t.Helper()
+	after := readRow(t, db, table, before["id"].(int64))
+	for name, old := range before {
+		switch name {
+		case column:
+			if after[name] != value {
+				t.Errorf("%s.%s = %v, want %v", table, name, after[name], value)
+			}
+		case "version":
+			if after[name] != old.(int64)+1 {
+				t.Errorf("%s.version went from %v to %v, want one more", table, old, after[name])
+			}
+		case "updated_at":
+			// A NULL updated_at reads as the zero time.
+			oldTime, _ := old.(time.Time)
+			newTime, _ := after[name].(time.Time)
+			if !newTime.After(oldTime) {
+				t.Errorf("%s.updated_at went from %v to %v, want a later time", table, old, after[name])
+			}
+		default:
+			if !reflect.DeepEqual(after[name], old) {
+				t.Errorf("%s.%s changed from %v to %v, but was not patched", table, name, old, after[name])
+			}
+		}
+	}
+	return after
+}
+
+// checkReturned checks that the record a Patch* method returned carries the
+// version and updated_at of the row.
+func checkReturned(t *testing.T, record UpdatableRecord, row map[string]interface{}) {
+	t.Helper()
+	if record.Version != row["version"] {
+		t.Errorf("returned version %d, the row has %v", record.Version, row["version"])
+	}
+	if updatedAt, _ := row["updated_at"].(time.Time); !record.UpdatedAt.Equal(updatedAt) {
+		t.Errorf("returned updated_at %v, the row has %v", record.UpdatedAt, row["updated_at"])
+	}
+}
+
+// readRow reads every column of the row with the given id, by column name.
+// Text columns come back as strings rather than byte slices.
+func readRow(t *testing.T, db *sql.DB, table string, id int64) map[string]interface{} {
+	t.Helper()
+	rows, err := db.Query("SELECT * FROM "+table+" WHERE id = $1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Fatalf("%s %d not found: %v", table, id, rows.Err())
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err = rows.Scan(pointers...); err != nil {
+		t.Fatal(err)
+	}
+	row := make(map[string]interface{}, len(columns))
+	for i, name := range columns {
+		if text, ok := values[i].([]byte); ok {
+			values[i] = string(text)
+		}
+		row[name] = values[i]
+	}
+	return row
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	. "go-learn-sql/common"
+	"go-learn-sql/common/dbtest"
+	"testing"
+	"time"
+)
+
+// TestRestoreBumpsVersion checks that restoring a soft-deleted record counts
+// as an update on each backend: its version and updated_at move on, so that a
+// copy read before the delete can no longer be written back.
+func TestRestoreBumpsVersion(t *testing.T) {
+	params := dbtest.Params(t)
+	for _, backend := range []string{"sql", "gorm"} {
+		t.Run(backend, func(t *testing.T) {
+			dao := backends[backend](params)
+			defer dao.Shutdown()
+			checkRestores(t, params, dao)
+		})
+	}
+}
+
+func checkRestores(t *testing.T, params DbParams, dao Dao) {
+	client := dao.InsertClient("Restore Test Client")
+	t.Cleanup(func() { dbtest.PurgeClient(t, params, client.Id) })
+	db := dbtest.Open(t, params)
+	before := readRow(t, db, "client", client.Id)
+	stale := NewClient(client.Id)
+	stale.Version = before["version"].(int64)
+	if err := dao.DeleteClient(client); err != nil {
+		t.Fatal(err)
+	}
+	deleted := readRow(t, db, "client", client.Id)
+	restored, err := dao.RestoreClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := readRow(t, db, "client", client.Id)
+	if after["deleted_at"] != nil {
+		t.Errorf("client.deleted_at = %v after the restore", after["deleted_at"])
+	}
+	if after["version"] != deleted["version"].(int64)+1 {
+		t.Errorf("client.version went from %v to %v, want one more", deleted["version"], after["version"])
+	}
+	deletedAt, _ := deleted["updated_at"].(time.Time)
+	if updatedAt, _ := after["updated_at"].(time.Time); !updatedAt.After(deletedAt) {
+		t.Errorf("client.updated_at went from %v to %v, want a later time", deleted["updated_at"], after["updated_at"])
+	}
+	checkReturned(t, restored.UpdatableRecord, after)
+	if _, err = dao.PatchClient(stale, ClientPatch{Name: String("Stale Test Client")}); err == nil {
+		t.Error("PatchClient() with the version read before the delete succeeded")
+	}
+}
@@ -0,0 +1,172 @@
+package scenario
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "go-learn-sql/common"
+	"sort"
+	"strings"
+)
+
+// errorKinds are the kinds of error a step can be expected to fail with.
+var errorKinds = map[string]func(err error) bool{
+	"any":                     func(error) bool { return true },
+	"not_found":               is(ErrNotFound),
+	"inactive_client":         is(ErrInactiveClient),
+	"inactive_product":        is(ErrInactiveProduct),
+	"client_has_customers":    is(ErrClientHasCustomers),
+	"same_client":             is(ErrSameClient),
+	"invalid_merge":           is(ErrInvalidMerge),
+	"mass_delete_protected":   is(ErrMassDeleteProtected),
+	"mass_delete_unconfirmed": is(ErrMassDeleteUnconfirmed),
+	"conflict": func(err error) bool {
+		var conflict *ConflictError
+		return errors.As(err, &conflict)
+	},
+	"code_collision": func(err error) bool {
+		var collision *CodeCollisionError
+		return errors.As(err, &collision)
+	},
+	"retries_exhausted": func(err error) bool {
+		var retry *RetryError
+		return errors.As(err, &retry)
+	},
+}
+
+func is(target error) func(err error) bool {
+	return func(err error) bool {
+		return errors.Is(err, target)
+	}
+}
+
+// assert checks the counts, values and links of the step against a snapshot,
+// and records every one that does not hold.
+func (runner *runner) assert(dao Dao, step Step) error {
+	state, err := dao.Snapshot()
+	if err != nil {
+		return err
+	}
+	actual := map[string]int{
+		"clients":   len(state.Clients),
+		"products":  len(state.Products),
+		"customers": len(state.Customers),
+		"links":     len(state.Links),
+	}
+	for _, table := range sortedKeys(step.Counts) {
+		count, known := actual[table]
+		if !known {
+			return fmt.Errorf("unknown table %q", table)
+		}
+		if count != step.Counts[table] {
+			runner.fail(fmt.Sprintf("expected %d %s, got %d", step.Counts[table], table, count))
+		}
+	}
+	for _, expected := range step.Values {
+		if err = runner.assertValue(state, expected); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedKeys(step.Links) {
+		customer, err := runner.customer(name)
+		if err != nil {
+			return err
+		}
+		var linked []string
+		for _, link := range state.Links {
+			if link.CustomerId == customer.Id {
+				linked = append(linked, link.Product)
+			}
+		}
+		expected := append([]string(nil), step.Links[name]...)
+		sort.Strings(expected)
+		sort.Strings(linked)
+		if strings.Join(linked, "\n") != strings.Join(expected, "\n") {
+			runner.fail(fmt.Sprintf("expected customer %s to be linked to %q, got %q", name, expected, linked))
+		}
+	}
+	return nil
+}
+
+// assertValue finds the named record among the live rows of the snapshot, and
+// compares the field as it appears in the JSON snapshot.
+func (runner *runner) assertValue(state State, expected ValueExpectation) error {
+	var (
+		what  string
+		id    int64
+		found interface{}
+	)
+	switch {
+	case expected.Client != "":
+		client, err := runner.client(expected.Client)
+		if err != nil {
+			return err
+		}
+		what, id = "client "+expected.Client, client.Id
+		for _, row := range state.Clients {
+			if row.Id == id {
+				found = row
+			}
+		}
+	case expected.Customer != "":
+		customer, err := runner.customer(expected.Customer)
+		if err != nil {
+			return err
+		}
+		what, id = "customer "+expected.Customer, customer.Id
+		for _, row := range state.Customers {
+			if row.Id == id {
+				found = row
+			}
+		}
+	case expected.Product != "":
+		product, err := runner.product(expected.Product)
+		if err != nil {
+			return err
+		}
+		what, id = "product "+expected.Product, product.Id
+		for _, row := range state.Products {
+			if row.Id == id {
+				found = row
+			}
+		}
+	default:
+		return errors.New("Value expectation names no client, customer or product")
+	}
+	if found == nil {
+		runner.fail(fmt.Sprintf("expected %s (id %d) to be live, but it is not", what, id))
+		return nil
+	}
+	data, err := json.Marshal(found)
+	if err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	value, known := fields[expected.Field]
+	if !known {
+		return fmt.Errorf("unknown field %q of %s", expected.Field, what)
+	}
+	if actual := fmt.Sprint(value); actual != expected.Equals {
+		runner.fail(fmt.Sprintf("expected %s %s to be %q, got %q", what, expected.Field, expected.Equals, actual))
+	}
+	return nil
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]int:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string][]string:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
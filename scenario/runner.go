@@ -0,0 +1,579 @@
+package scenario
+
+import (
+	"database/sql"
+	"fmt"
+	. "go-learn-sql/common"
+	"go-learn-sql/seed"
+	"log"
+	"strings"
+)
+
+// Observer hears about every top-level step once it has run, and about every
+// print step, which marks a point at which the whole database state is worth
+// looking at.
+type Observer interface {
+	Step(name string)
+	Phase(name string)
+}
+
+// runner keeps the records created by the scenario under the names their steps
+// gave them, and replaces them with the updated record after every write, so
+// that later steps pass the current version.
+// at names the top-level step being run, and failures collects the
+// expectations that did not hold.
+type runner struct {
+	observer  Observer
+	clients   map[string]Client
+	customers map[string]Customer
+	products  map[string]Product
+	at        string
+	failures  []string
+}
+
+// FailedError lists every expectation of a scenario run that did not hold.
+type FailedError struct {
+	Failures []string
+}
+
+func (err *FailedError) Error() string {
+	return fmt.Sprintf("%d expectation(s) failed:\n  %s", len(err.Failures), strings.Join(err.Failures, "\n  "))
+}
+
+// Run runs the steps of scenario against dao in order. A step that fails
+// unexpectedly stops the run, but failed expectations, from assert steps and
+// from steps with expect_error set, are collected and the run goes on; if there
+// are any, Run returns them all as a *FailedError once the run is over.
+//
+// The actions, and the fields they read besides description and expect_error:
+//
+//	insert_client, insert_product        name, as
+//	insert_customer, upsert_customer     client, code, first_name, last_name, email, as
+//	bulk_insert_customers                steps (insert_customer steps, inserted at once)
+//	seed                                 seed (the generator config; the generated
+//	                                     records get no names)
+//	update_client_name                   client, name
+//	update_product_name                  product, name
+//	update_customer_name                 customer, name (the full name)
+//	patch_customer                       customer, and whichever of first_name,
+//	                                     middle_name, last_name and email are set
+//	update_customer_email_and_link       customer, email, product
+//	link                                 customer, product
+//	activate_client, deactivate_client   client
+//	activate_product, deactivate_product product
+//	delete_client                        client
+//	delete_client_cascade                client, dry_run
+//	delete_customer                      customer
+//	transfer_customer                    customer, client (the one to move it to)
+//	merge_duplicates                     client
+//	delete_all                           table (clients, products or customers), confirm
+//	purge
+//	transaction                          isolation, retry, steps
+//	batch                                mode (all_or_nothing or best_effort), steps
+//	print                                description (the name of the phase)
+//	assert                               counts (of clients, products, customers
+//	                                     and links), values, links (the product
+//	                                     names each named customer is linked to)
+//
+// The error kinds that expect_error takes are listed in assert.go.
+func Run(dao Dao, scenario Scenario, observer Observer) error {
+	runner := &runner{
+		observer:  observer,
+		clients:   make(map[string]Client),
+		customers: make(map[string]Customer),
+		products:  make(map[string]Product),
+	}
+	log.Println("Run scenario", scenario.Name)
+	for i, step := range scenario.Steps {
+		runner.at = fmt.Sprintf("step %d (%s)", i+1, step)
+		if err := runner.run(dao, step); err != nil {
+			runner.fail(err.Error())
+			break
+		}
+		if step.Action != "print" {
+			observer.Step(step.String())
+		}
+	}
+	if len(runner.failures) > 0 {
+		return &FailedError{Failures: runner.failures}
+	}
+	return nil
+}
+
+func (runner *runner) run(dao Dao, step Step) error {
+	if step.ExpectError == "" {
+		return runner.exec(dao, step)
+	}
+	matches, known := errorKinds[step.ExpectError]
+	if !known {
+		return fmt.Errorf("unknown error kind %q", step.ExpectError)
+	}
+	err := runner.exec(dao, step)
+	switch {
+	case err == nil:
+		runner.fail(fmt.Sprintf("%s succeeded, but was expected to fail with %s", step, step.ExpectError))
+	case !matches(err):
+		runner.fail(fmt.Sprintf("%s failed with %q, but was expected to fail with %s", step, err, step.ExpectError))
+	default:
+		log.Println(step, "failed, as expected:", err)
+	}
+	return nil
+}
+
+func (runner *runner) fail(message string) {
+	log.Println("FAILED:", runner.at+":", message)
+	runner.failures = append(runner.failures, runner.at+": "+message)
+}
+
+func (runner *runner) exec(dao Dao, step Step) error {
+	switch step.Action {
+	case "insert_client":
+		runner.clients[step.As] = dao.InsertClient(step.Name)
+		return nil
+	case "insert_product":
+		runner.products[step.As] = dao.InsertProduct(step.Name)
+		return nil
+	case "insert_customer":
+		client, err := runner.client(step.Client)
+		if err != nil {
+			return err
+		}
+		runner.customers[step.As] = dao.InsertCustomer(step.Code, step.FirstName, step.LastName, step.Email, client)
+		return nil
+	case "bulk_insert_customers":
+		return runner.bulkInsertCustomers(dao, step)
+	case "seed":
+		config := seed.DefaultConfig
+		if step.Seed != nil {
+			config = *step.Seed
+		}
+		data, err := seed.Generate(config)
+		if err != nil {
+			return err
+		}
+		_, _, _, err = seed.Insert(dao, data)
+		return err
+	case "upsert_customer":
+		client, err := runner.client(step.Client)
+		if err != nil {
+			return err
+		}
+		customer, upserted, err := dao.UpsertCustomer(step.Code, step.FirstName, step.LastName, step.Email, client)
+		if err != nil {
+			return err
+		}
+		log.Println("Customer", customer.Id, "was", upserted)
+		runner.customers[step.As] = customer
+		return nil
+	case "update_client_name":
+		return runner.updateClient(step, func(client Client) (Client, error) {
+			return dao.UpdateClientName(client, step.Name)
+		})
+	case "activate_client":
+		return runner.updateClient(step, dao.ActivateClient)
+	case "deactivate_client":
+		return runner.updateClient(step, dao.DeactivateClient)
+	case "update_product_name":
+		return runner.updateProduct(step, func(product Product) (Product, error) {
+			return dao.UpdateProductName(product, step.Name)
+		})
+	case "activate_product":
+		return runner.updateProduct(step, dao.ActivateProduct)
+	case "deactivate_product":
+		return runner.updateProduct(step, dao.DeactivateProduct)
+	case "update_customer_name":
+		return runner.updateCustomer(step, func(customer Customer) (Customer, error) {
+			return dao.UpdateCustomerName(customer, step.Name)
+		})
+	case "patch_customer":
+		return runner.updateCustomer(step, func(customer Customer) (Customer, error) {
+			return dao.PatchCustomer(customer, CustomerPatch{
+				FirstName:    optional(step.FirstName),
+				MiddleName:   optional(step.MiddleName),
+				LastName:     optional(step.LastName),
+				EmailAddress: optional(step.Email),
+			})
+		})
+	case "update_customer_email_and_link":
+		product, err := runner.product(step.Product)
+		if err != nil {
+			return err
+		}
+		return runner.updateCustomer(step, func(customer Customer) (Customer, error) {
+			return dao.UpdateCustomerEmailAndLinkToProduct(customer, step.Email, product)
+		})
+	case "link":
+		customer, err := runner.customer(step.Customer)
+		if err != nil {
+			return err
+		}
+		product, err := runner.product(step.Product)
+		if err != nil {
+			return err
+		}
+		return dao.LinkCustomerToProduct(customer, product)
+	case "delete_client":
+		client, err := runner.client(step.Client)
+		if err != nil {
+			return err
+		}
+		return dao.DeleteClient(client)
+	case "delete_client_cascade":
+		client, err := runner.client(step.Client)
+		if err != nil {
+			return err
+		}
+		report, err := dao.DeleteClientCascade(client, step.DryRun)
+		if err != nil {
+			return err
+		}
+		log.Printf("Client %d cascade removed %d link(s) and %d customer(s) (dry run: %t)",
+			client.Id, report.Links, report.Customers, report.DryRun)
+		return nil
+	case "delete_customer":
+		customer, err := runner.customer(step.Customer)
+		if err != nil {
+			return err
+		}
+		return dao.DeleteCustomer(customer)
+	case "transfer_customer":
+		customer, err := runner.customer(step.Customer)
+		if err != nil {
+			return err
+		}
+		client, err := runner.client(step.Client)
+		if err != nil {
+			return err
+		}
+		_, err = dao.TransferCustomers(NewClient(customer.ClientId), client, []int64{customer.Id})
+		if err != nil {
+			return err
+		}
+		// An empty patch reads the moved customer back, with the client and
+		// version the transfer left it at.
+		if customer, err = dao.PatchCustomer(NewCustomer(customer.Id), CustomerPatch{}); err != nil {
+			return err
+		}
+		runner.customers[step.Customer] = customer
+		return nil
+	case "merge_duplicates":
+		client, err := runner.client(step.Client)
+		if err != nil {
+			return err
+		}
+		candidates, err := dao.FindDuplicateCustomers(client)
+		if err != nil {
+			return err
+		}
+		for _, candidate := range candidates {
+			log.Printf("Customer %d looks like customer %d (%s, similarity %.2f)",
+				candidate.Duplicate.Id, candidate.Customer.Id, candidate.Match, candidate.Similarity)
+		}
+		for _, group := range groupDuplicates(candidates) {
+			if err = dao.MergeCustomers(group.survivor, group.duplicates); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "delete_all":
+		return deleteAll(dao, step.Table, step.Confirm)
+	case "purge":
+		purged, err := dao.Purge(0)
+		if err != nil {
+			return err
+		}
+		log.Println("Purged", purged, "record(s)")
+		return nil
+	case "transaction":
+		return runner.transaction(dao, step)
+	case "batch":
+		return runner.batch(dao, step)
+	case "print":
+		runner.observer.Phase(step.String())
+		return nil
+	case "assert":
+		return runner.assert(dao, step)
+	}
+	return fmt.Errorf("unknown action %q", step.Action)
+}
+
+// duplicateGroup is a customer together with the duplicates to merge into it.
+type duplicateGroup struct {
+	survivor   Customer
+	duplicates []Customer
+}
+
+// groupDuplicates folds the candidate pairs into one group per survivor, so
+// that every duplicate is merged once: of mutual duplicates A, B and C, the
+// pair of B and C is already taken care of by merging both into A. The pairs
+// come ordered by the id of their first customer, which is the lower one, so a
+// duplicate is never picked as a survivor after it was merged.
+func groupDuplicates(candidates []DuplicateCandidate) []duplicateGroup {
+	var groups []duplicateGroup
+	groupOf := make(map[int64]int)
+	for _, candidate := range candidates {
+		if _, grouped := groupOf[candidate.Duplicate.Id]; grouped {
+			continue
+		}
+		i, grouped := groupOf[candidate.Customer.Id]
+		if !grouped {
+			i = len(groups)
+			groups = append(groups, duplicateGroup{survivor: candidate.Customer})
+			groupOf[candidate.Customer.Id] = i
+		}
+		groups[i].duplicates = append(groups[i].duplicates, candidate.Duplicate)
+		groupOf[candidate.Duplicate.Id] = i
+	}
+	return groups
+}
+
+func (runner *runner) client(name string) (Client, error) {
+	client, found := runner.clients[name]
+	if !found {
+		return client, fmt.Errorf("unknown client %q", name)
+	}
+	return client, nil
+}
+
+func (runner *runner) customer(name string) (Customer, error) {
+	customer, found := runner.customers[name]
+	if !found {
+		return customer, fmt.Errorf("unknown customer %q", name)
+	}
+	return customer, nil
+}
+
+func (runner *runner) product(name string) (Product, error) {
+	product, found := runner.products[name]
+	if !found {
+		return product, fmt.Errorf("unknown product %q", name)
+	}
+	return product, nil
+}
+
+// The update* helpers apply a write to the record named by the step and keep
+// the updated record.
+
+func (runner *runner) updateClient(step Step, update func(Client) (Client, error)) error {
+	client, err := runner.client(step.Client)
+	if err != nil {
+		return err
+	}
+	if client, err = update(client); err != nil {
+		return err
+	}
+	runner.clients[step.Client] = client
+	return nil
+}
+
+func (runner *runner) updateProduct(step Step, update func(Product) (Product, error)) error {
+	product, err := runner.product(step.Product)
+	if err != nil {
+		return err
+	}
+	if product, err = update(product); err != nil {
+		return err
+	}
+	runner.products[step.Product] = product
+	return nil
+}
+
+func (runner *runner) updateCustomer(step Step, update func(Customer) (Customer, error)) error {
+	customer, err := runner.customer(step.Customer)
+	if err != nil {
+		return err
+	}
+	if customer, err = update(customer); err != nil {
+		return err
+	}
+	runner.customers[step.Customer] = customer
+	return nil
+}
+
+func (runner *runner) bulkInsertCustomers(dao Dao, step Step) error {
+	customers := make([]Customer, len(step.Steps))
+	for i, nested := range step.Steps {
+		if nested.Action != "insert_customer" {
+			return fmt.Errorf("%s: only insert_customer steps can be bulk inserted", nested)
+		}
+		client, err := runner.client(nested.Client)
+		if err != nil {
+			return err
+		}
+		customers[i] = Customer{ClientId: client.Id, Code: nested.Code, FirstName: nested.FirstName,
+			LastName: nested.LastName, EmailAddress: nested.Email}
+	}
+	ids, err := dao.BulkInsertCustomers(customers)
+	if err != nil {
+		return err
+	}
+	for i, nested := range step.Steps {
+		customers[i].Id = ids[i]
+		runner.customers[nested.As] = customers[i]
+	}
+	return nil
+}
+
+// transaction runs the nested steps in one transaction, or in a savepoint when
+// it is itself nested in a transaction.
+func (runner *runner) transaction(dao Dao, step Step) error {
+	options := TxOptions{}
+	switch step.Isolation {
+	case "":
+	case "read committed":
+		options.Isolation = sql.LevelReadCommitted
+	case "repeatable read":
+		options.Isolation = sql.LevelRepeatableRead
+	case "serializable":
+		options.Isolation = sql.LevelSerializable
+	default:
+		return fmt.Errorf("unknown isolation level %q", step.Isolation)
+	}
+	if step.Retry {
+		options.Retry = DefaultRetryPolicy
+	}
+	// Every attempt runs the nested steps against a fresh copy of the runner,
+	// which only replaces it once the transaction has committed: a rollback
+	// must not leave names bound to rows that are gone, and a retry must not
+	// report the failures of the attempts before it.
+	staged := stage(runner)
+	err := dao.WithTx(options, func(tx Dao) error {
+		staged = stage(runner)
+		for _, nested := range step.Steps {
+			if err := staged.run(tx, nested); err != nil {
+				return fmt.Errorf("%s: %w", nested, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	commit(runner, staged)
+	return nil
+}
+
+// stage copies parent without its failures, so that steps can run against the
+// copy without touching parent until commit.
+func stage(parent *runner) *runner {
+	staged := &runner{
+		observer:  parent.observer,
+		clients:   make(map[string]Client, len(parent.clients)),
+		customers: make(map[string]Customer, len(parent.customers)),
+		products:  make(map[string]Product, len(parent.products)),
+		at:        parent.at,
+	}
+	for name, client := range parent.clients {
+		staged.clients[name] = client
+	}
+	for name, customer := range parent.customers {
+		staged.customers[name] = customer
+	}
+	for name, product := range parent.products {
+		staged.products[name] = product
+	}
+	return staged
+}
+
+// commit hands the records and failures of a runner made by stage over to its
+// parent.
+func commit(parent *runner, staged *runner) {
+	parent.clients = staged.clients
+	parent.customers = staged.customers
+	parent.products = staged.products
+	parent.failures = append(parent.failures, staged.failures...)
+}
+
+// batch runs the nested steps as the operations of one batch. In a best-effort
+// batch a failing operation does not fail the step; its error is only logged.
+// An all-or-nothing batch that rolls back fails the step with the error of the
+// operation that failed.
+func (runner *runner) batch(dao Dao, step Step) error {
+	mode := AllOrNothing
+	switch step.Mode {
+	case "", "all_or_nothing":
+	case "best_effort":
+		mode = BestEffort
+	default:
+		return fmt.Errorf("unknown batch mode %q", step.Mode)
+	}
+	// As in transaction, the steps run against a staged copy of the runner
+	// that only replaces it once the batch has committed.
+	batch := &batchStage{parent: runner, staged: stage(runner)}
+	operations := make([]Operation, len(step.Steps))
+	for i, nested := range step.Steps {
+		operations[i] = stepOp{batch: batch, first: i == 0, step: nested}
+	}
+	report, err := dao.RunBatch(operations, mode)
+	if err != nil {
+		return err
+	}
+	for _, result := range report.Results {
+		log.Printf("%-50s: %v", result.Operation, result.Err)
+	}
+	if !report.Committed {
+		for _, result := range report.Results {
+			if result.Err != nil {
+				return fmt.Errorf("batch rolled back: %s: %w", result.Operation, result.Err)
+			}
+		}
+		return fmt.Errorf("batch rolled back")
+	}
+	commit(runner, batch.staged)
+	return nil
+}
+
+// batchStage holds the runner that the operations of one batch attempt stage
+// their records on.
+type batchStage struct {
+	parent *runner
+	staged *runner
+}
+
+// stepOp runs a scenario step as a batch operation. The first operation starts
+// every attempt of the batch afresh from the parent runner, and each operation
+// only hands its records over to the batch once it has succeeded, so that the
+// ones a best-effort batch rolls back leave no names behind.
+type stepOp struct {
+	batch *batchStage
+	first bool
+	step  Step
+}
+
+func (op stepOp) Apply(dao Dao) error {
+	if op.first {
+		op.batch.staged = stage(op.batch.parent)
+	}
+	staged := stage(op.batch.staged)
+	if err := staged.run(dao, op.step); err != nil {
+		return err
+	}
+	commit(op.batch.staged, staged)
+	return nil
+}
+
+func (op stepOp) String() string {
+	return op.step.String()
+}
+
+func deleteAll(dao Dao, table string, confirm string) error {
+	var err error
+	switch table {
+	case "clients":
+		_, err = dao.DeleteAllClients(confirm)
+	case "products":
+		_, err = dao.DeleteAllProducts(confirm)
+	case "customers":
+		_, err = dao.DeleteAllCustomers(confirm)
+	default:
+		err = fmt.Errorf("unknown table %q", table)
+	}
+	return err
+}
+
+func optional(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
@@ -0,0 +1,25 @@
+package scenario
+
+import (
+	. "go-learn-sql/common"
+	"reflect"
+	"testing"
+)
+
+func TestGroupDuplicatesMergesEachCustomerOnce(t *testing.T) {
+	a, b, c, d, e := NewCustomer(1), NewCustomer(2), NewCustomer(3), NewCustomer(4), NewCustomer(5)
+	candidates := []DuplicateCandidate{
+		{Customer: a, Duplicate: b},
+		{Customer: a, Duplicate: c},
+		{Customer: b, Duplicate: c},
+		{Customer: b, Duplicate: d},
+		{Customer: e, Duplicate: NewCustomer(6)},
+	}
+	want := []duplicateGroup{
+		{survivor: a, duplicates: []Customer{b, c, d}},
+		{survivor: e, duplicates: []Customer{NewCustomer(6)}},
+	}
+	if got := groupDuplicates(candidates); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupDuplicates() = %+v, want %+v", got, want)
+	}
+}
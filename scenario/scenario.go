@@ -0,0 +1,104 @@
+// Package scenario loads scenarios, lists of steps run against a Dao that are
+// written in YAML or JSON, and runs them.
+package scenario
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-learn-sql/seed"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+type Scenario struct {
+	Name  string `yaml:"name" json:"name"`
+	Steps []Step `yaml:"steps" json:"steps"`
+}
+
+// Step is one action of a scenario. Which of the other fields an action reads
+// is listed with the action in runner.go. Records are referred to by the name
+// given in As by the step that created them.
+type Step struct {
+	Action      string `yaml:"action" json:"action"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+	As          string `yaml:"as,omitempty" json:"as,omitempty"`
+
+	Client   string `yaml:"client,omitempty" json:"client,omitempty"`
+	Customer string `yaml:"customer,omitempty" json:"customer,omitempty"`
+	Product  string `yaml:"product,omitempty" json:"product,omitempty"`
+
+	Name       string `yaml:"name,omitempty" json:"name,omitempty"`
+	Code       string `yaml:"code,omitempty" json:"code,omitempty"`
+	FirstName  string `yaml:"first_name,omitempty" json:"first_name,omitempty"`
+	MiddleName string `yaml:"middle_name,omitempty" json:"middle_name,omitempty"`
+	LastName   string `yaml:"last_name,omitempty" json:"last_name,omitempty"`
+	Email      string `yaml:"email,omitempty" json:"email,omitempty"`
+
+	Isolation string `yaml:"isolation,omitempty" json:"isolation,omitempty"`
+	Retry     bool   `yaml:"retry,omitempty" json:"retry,omitempty"`
+	Mode      string `yaml:"mode,omitempty" json:"mode,omitempty"`
+	DryRun    bool   `yaml:"dry_run,omitempty" json:"dry_run,omitempty"`
+	Table     string `yaml:"table,omitempty" json:"table,omitempty"`
+	Confirm   string `yaml:"confirm,omitempty" json:"confirm,omitempty"`
+
+	Seed *seed.Config `yaml:"seed,omitempty" json:"seed,omitempty"`
+
+	Counts map[string]int      `yaml:"counts,omitempty" json:"counts,omitempty"`
+	Values []ValueExpectation  `yaml:"values,omitempty" json:"values,omitempty"`
+	Links  map[string][]string `yaml:"links,omitempty" json:"links,omitempty"`
+
+	// ExpectError is the kind of error the step must fail with, or "any".
+	ExpectError string `yaml:"expect_error,omitempty" json:"expect_error,omitempty"`
+	Steps       []Step `yaml:"steps,omitempty" json:"steps,omitempty"`
+}
+
+// ValueExpectation says that a field of the live client, customer or product
+// with the given name must have the value Equals. Field names are those of the
+// JSON state snapshot, such as name, active or email_address.
+type ValueExpectation struct {
+	Client   string `yaml:"client,omitempty" json:"client,omitempty"`
+	Customer string `yaml:"customer,omitempty" json:"customer,omitempty"`
+	Product  string `yaml:"product,omitempty" json:"product,omitempty"`
+	Field    string `yaml:"field" json:"field"`
+	Equals   string `yaml:"equals" json:"equals"`
+}
+
+// String names the step in logs and reports.
+func (step Step) String() string {
+	if step.Description != "" {
+		return step.Description
+	}
+	return step.Action
+}
+
+// Load reads a scenario file, as JSON when its name ends in .json and as YAML
+// otherwise.
+func Load(path string) (Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Scenario{}, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return ParseJSON(data)
+	}
+	return ParseYAML(data)
+}
+
+// ParseYAML and ParseJSON reject unknown fields, so that a misspelt field
+// fails the load instead of being silently ignored.
+
+func ParseYAML(data []byte) (Scenario, error) {
+	var scenario Scenario
+	err := yaml.UnmarshalStrict(data, &scenario)
+	return scenario, err
+}
+
+func ParseJSON(data []byte) (Scenario, error) {
+	var scenario Scenario
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&scenario)
+	return scenario, err
+}
@@ -0,0 +1,9 @@
+-- Soft delete: rows are flagged with deleted_at instead of being removed, and
+-- Purge hard-deletes them once the retention period has passed.
+ALTER TABLE client ADD COLUMN deleted_at timestamp with time zone;
+ALTER TABLE customer ADD COLUMN deleted_at timestamp with time zone;
+ALTER TABLE product ADD COLUMN deleted_at timestamp with time zone;
+
+CREATE INDEX idx_client_deleted_at ON client (deleted_at);
+CREATE INDEX idx_customer_deleted_at ON customer (deleted_at);
+CREATE INDEX idx_product_deleted_at ON product (deleted_at);
@@ -0,0 +1,5 @@
+-- Optimistic locking: every update bumps version and only applies when the
+-- row is still at the version the caller read.
+ALTER TABLE client ADD COLUMN version bigint NOT NULL DEFAULT 0;
+ALTER TABLE customer ADD COLUMN version bigint NOT NULL DEFAULT 0;
+ALTER TABLE product ADD COLUMN version bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,25 @@
+-- Customer codes are unique per client; UpsertCustomer relies on this
+-- constraint for its ON CONFLICT target. Soft-deleted rows keep their code, so
+-- re-sending one of them revives it rather than inserting a duplicate.
+
+-- Customers that already share a code under their client are folded into one
+-- first: the live one if there is one, the oldest otherwise. Their product
+-- links move over to it before they are deleted; 004 drops the links that this
+-- doubles up.
+CREATE TEMPORARY TABLE customer_code_duplicate AS
+SELECT id, first_value(id) OVER (PARTITION BY client_id, code ORDER BY deleted_at IS NOT NULL, id) AS keep_id
+FROM customer;
+DELETE FROM customer_code_duplicate WHERE id = keep_id;
+
+UPDATE customer_product cp
+SET customer_id = d.keep_id
+FROM customer_code_duplicate d
+WHERE cp.customer_id = d.id;
+
+DELETE FROM customer c
+USING customer_code_duplicate d
+WHERE c.id = d.id;
+
+DROP TABLE customer_code_duplicate;
+
+ALTER TABLE customer ADD CONSTRAINT customer_client_id_code_key UNIQUE (client_id, code);
@@ -0,0 +1,12 @@
+-- Duplicate detection compares customer names by trigram similarity.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- A customer is linked to a product at most once; merging customers relies on
+-- this when it moves links over to the survivor.
+DELETE FROM customer_product a
+USING customer_product b
+WHERE a.customer_id = b.customer_id
+  AND a.product_id = b.product_id
+  AND a.id > b.id;
+ALTER TABLE customer_product
+  ADD CONSTRAINT customer_product_customer_id_product_id_key UNIQUE (customer_id, product_id);
@@ -0,0 +1,207 @@
+// Package seed generates realistic looking clients, customers and products from
+// a fixed random seed, so that the same configuration always produces the same
+// data, and inserts them through a Dao.
+package seed
+
+import (
+	"fmt"
+	. "go-learn-sql/common"
+	"log"
+	"math/rand"
+	"strings"
+)
+
+// Config sizes the generated data. Every customer is linked to between zero
+// and MaxLinks distinct products.
+type Config struct {
+	Seed               int64 `yaml:"seed" json:"seed"`
+	Clients            int   `yaml:"clients" json:"clients"`
+	CustomersPerClient int   `yaml:"customers_per_client" json:"customers_per_client"`
+	Products           int   `yaml:"products" json:"products"`
+	MaxLinks           int   `yaml:"max_links" json:"max_links"`
+}
+
+var DefaultConfig = Config{
+	Seed:               1,
+	Clients:            3,
+	CustomersPerClient: 10,
+	Products:           5,
+	MaxLinks:           2,
+}
+
+// Data is a generated data set. Customers refer to their client, and Links to
+// their customer and product, by index, since nothing has an id until it is
+// inserted.
+type Data struct {
+	Clients   []string
+	Customers []GeneratedCustomer
+	Products  []string
+	Links     []Link
+}
+
+type GeneratedCustomer struct {
+	Client       int
+	Code         string
+	FirstName    string
+	LastName     string
+	EmailAddress string
+}
+
+type Link struct {
+	Customer int
+	Product  int
+}
+
+// Validate rejects negative sizes. The config usually comes straight from a
+// scenario file, so the error names the fields as they are spelled there.
+func (config Config) Validate() error {
+	sizes := []struct {
+		field string
+		value int
+	}{
+		{"clients", config.Clients},
+		{"customers_per_client", config.CustomersPerClient},
+		{"products", config.Products},
+		{"max_links", config.MaxLinks},
+	}
+	for _, size := range sizes {
+		if size.value < 0 {
+			return fmt.Errorf("seed %s must not be negative, got %d", size.field, size.value)
+		}
+	}
+	return nil
+}
+
+// Generate builds the data set for config, once it is valid. It only depends
+// on config, so two calls with the same config return the same data.
+func Generate(config Config) (Data, error) {
+	if err := config.Validate(); err != nil {
+		return Data{}, err
+	}
+	random := rand.New(rand.NewSource(config.Seed))
+	var data Data
+	data.Clients = uniqueNames(config.Clients, func() string {
+		return pick(random, cities) + " " + pick(random, companyNouns) + " " + pick(random, companySuffixes)
+	})
+	for client, name := range data.Clients {
+		domain := domainOf(name)
+		// Codes are drawn without replacement, so they are unique per client.
+		codes := random.Perm(max(90000, config.CustomersPerClient))
+		for i := 0; i < config.CustomersPerClient; i++ {
+			firstName, lastName := pick(random, firstNames), pick(random, lastNames)
+			data.Customers = append(data.Customers, GeneratedCustomer{
+				Client:       client,
+				Code:         fmt.Sprintf("%05d", 10000+codes[i]),
+				FirstName:    firstName,
+				LastName:     lastName,
+				EmailAddress: fmt.Sprintf("%s.%s%d@%s", mailbox(firstName), mailbox(lastName), i+1, domain),
+			})
+		}
+	}
+	data.Products = uniqueNames(config.Products, func() string {
+		return pick(random, productAdjectives) + " " + pick(random, productNouns) + " " + pick(random, productKinds)
+	})
+	for customer := range data.Customers {
+		if len(data.Products) == 0 {
+			break
+		}
+		links := random.Intn(config.MaxLinks + 1)
+		for _, product := range random.Perm(len(data.Products))[:min(links, len(data.Products))] {
+			data.Links = append(data.Links, Link{Customer: customer, Product: product})
+		}
+	}
+	return data, nil
+}
+
+// Insert writes the data set through dao: clients and products one by one,
+// customers in one bulk insert, and then the links. It returns the inserted
+// records in the order of data.
+func Insert(dao Dao, data Data) ([]Client, []Customer, []Product, error) {
+	log.Printf("Seed %d client(s), %d customer(s), %d product(s) and %d link(s)",
+		len(data.Clients), len(data.Customers), len(data.Products), len(data.Links))
+	clients := make([]Client, len(data.Clients))
+	for i, name := range data.Clients {
+		clients[i] = dao.InsertClient(name)
+	}
+	customers := make([]Customer, len(data.Customers))
+	for i, generated := range data.Customers {
+		customers[i] = Customer{
+			ClientId:     clients[generated.Client].Id,
+			Code:         generated.Code,
+			FirstName:    generated.FirstName,
+			LastName:     generated.LastName,
+			EmailAddress: generated.EmailAddress,
+		}
+	}
+	ids, err := dao.BulkInsertCustomers(customers)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for i := range customers {
+		customers[i].Id = ids[i]
+	}
+	products := make([]Product, len(data.Products))
+	for i, name := range data.Products {
+		products[i] = dao.InsertProduct(name)
+	}
+	for _, link := range data.Links {
+		if err = dao.LinkCustomerToProduct(customers[link.Customer], products[link.Product]); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return clients, customers, products, nil
+}
+
+// uniqueNames draws n names from next, numbering the repeats.
+func uniqueNames(n int, next func() string) []string {
+	names := make([]string, n)
+	seen := make(map[string]int)
+	for i := range names {
+		name := next()
+		if seen[name]++; seen[name] > 1 {
+			name = fmt.Sprintf("%s %d", name, seen[name])
+		}
+		names[i] = name
+	}
+	return names
+}
+
+func pick(random *rand.Rand, words []string) string {
+	return words[random.Intn(len(words))]
+}
+
+// mailbox keeps only the letters of a name, lowercased, so that it is valid in
+// the local part of an email address.
+func mailbox(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return -1
+	}, name)
+}
+
+func domainOf(clientName string) string {
+	words := strings.Fields(clientName)
+	for i, word := range words {
+		words[i] = mailbox(word)
+	}
+	return strings.Join(words, "-") + ".example.com"
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
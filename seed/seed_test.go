@@ -0,0 +1,37 @@
+package seed
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGenerateRejectsNegativeSizes(t *testing.T) {
+	for _, config := range []Config{
+		{Clients: -1},
+		{Clients: 1, CustomersPerClient: -1},
+		{Products: -1},
+		{Clients: 1, CustomersPerClient: 1, Products: 1, MaxLinks: -1},
+	} {
+		if _, err := Generate(config); err == nil {
+			t.Errorf("Generate(%+v) succeeded", config)
+		}
+	}
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	first, err := Generate(DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Generate(DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Error("Generate returned different data for the same config")
+	}
+	want := DefaultConfig.Clients * DefaultConfig.CustomersPerClient
+	if len(first.Customers) != want {
+		t.Errorf("Generate made %d customers, want %d", len(first.Customers), want)
+	}
+}
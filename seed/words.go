@@ -0,0 +1,48 @@
+package seed
+
+var firstNames = []string{
+	"Aaliyah", "Aaron", "Abigail", "Adam", "Aiden", "Alexander", "Amelia", "Andrew", "Anna", "Anthony",
+	"Aria", "Ava", "Benjamin", "Brooklyn", "Caleb", "Camila", "Carter", "Charlotte", "Chloe", "Christopher",
+	"Claire", "Daniel", "David", "Dylan", "Eleanor", "Elijah", "Elizabeth", "Ella", "Emily", "Emma",
+	"Ethan", "Evelyn", "Gabriel", "Grace", "Hannah", "Harper", "Henry", "Isaac", "Isabella", "Jack",
+	"Jackson", "Jacob", "James", "Jayden", "John", "Joseph", "Joshua", "Julian", "Layla", "Leah",
+	"Liam", "Lily", "Logan", "Lucas", "Luke", "Madison", "Mason", "Matthew", "Mia", "Michael",
+	"Mila", "Natalie", "Noah", "Nora", "Oliver", "Olivia", "Owen", "Penelope", "Riley", "Ryan",
+	"Samuel", "Scarlett", "Sebastian", "Sofia", "Sophia", "Stella", "Victoria", "William", "Wyatt", "Zoey",
+}
+
+var lastNames = []string{
+	"Adams", "Allen", "Anderson", "Baker", "Bell", "Brooks", "Brown", "Campbell", "Carter", "Clark",
+	"Collins", "Cook", "Cooper", "Davis", "Diaz", "Edwards", "Evans", "Flores", "Garcia", "Gomez",
+	"Gonzalez", "Green", "Hall", "Harris", "Hernandez", "Hill", "Jackson", "Johnson", "Jones", "Kelly",
+	"King", "Lee", "Lewis", "Lopez", "Martin", "Martinez", "Miller", "Mitchell", "Moore", "Morgan",
+	"Morris", "Murphy", "Nelson", "Nguyen", "O'Brien", "Parker", "Perez", "Phillips", "Ramirez", "Reed",
+	"Rivera", "Roberts", "Robinson", "Rodriguez", "Rogers", "Sanchez", "Scott", "Smith", "Stewart", "Taylor",
+	"Thomas", "Thompson", "Torres", "Turner", "Walker", "White", "Williams", "Wilson", "Wright", "Young",
+}
+
+var cities = []string{
+	"Atlanta", "Austin", "Boston", "Charlotte", "Chicago", "Dallas", "Denver", "Detroit", "Houston", "Memphis",
+	"Miami", "Milwaukee", "Oakland", "Orlando", "Phoenix", "Portland", "Sacramento", "Seattle", "Toronto", "Utah",
+}
+
+var companyNouns = []string{
+	"Anchor", "Beacon", "Bridge", "Capital", "Cedar", "Crest", "Falcon", "Harbor", "Keystone", "Lantern",
+	"Maple", "Meridian", "Summit", "Pioneer", "Redwood", "Sterling", "Titan", "Union", "Vertex", "Willow",
+}
+
+var companySuffixes = []string{
+	"Bank", "Credit Union", "Financial", "Group", "Holdings", "Insurance", "Mutual", "Partners", "Telecom", "Trust",
+}
+
+var productAdjectives = []string{
+	"Advanced", "Complete", "Essential", "Fantastic", "Premium", "Proactive", "Smart", "Stupendous", "Super", "Total",
+}
+
+var productNouns = []string{
+	"Credit", "Cyber", "Family", "Fraud", "Identity", "Personal", "Privacy", "Wallet",
+}
+
+var productKinds = []string{
+	"Alerts", "Monitoring", "Protection", "Resolution Service", "Restoration", "Shield", "Watch",
+}
@@ -2,19 +2,39 @@ package sql
 
 import (
 	"database/sql"
-	_ "github.com/lib/pq"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
 	. "go-learn-sql/common"
 	"log"
+	"sort"
 	"strings"
 	"time"
 )
 
+// sqlDao runs its statements through queryer, which is the connection pool,
+// or the open transaction when the dao was handed out by withTx. depth counts
+// the savepoints nested inside that transaction. params are the connection
+// parameters the dao was opened with.
 type sqlDao struct {
-	*sql.DB
+	queryer
+	db     *sql.DB
+	tx     *sql.Tx
+	depth  int
+	params DbParams
 }
 
 func Init() sqlDao {
-	connStr := DefaultConnectionString()
+	return InitWith(DefaultParams)
+}
+
+// InitWith connects to the database described by params.
+func InitWith(params DbParams) sqlDao {
+	params, err := ApplyProfile(params)
+	if err != nil {
+		log.Fatal(err)
+	}
+	connStr := ConnectionString(params)
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		log.Fatal(err)
@@ -24,149 +44,79 @@ func Init() sqlDao {
 		db.Close()
 		log.Fatal(err)
 	}
-	return sqlDao{db}
+	return sqlDao{queryer: db, db: db, params: params}
 }
 
 func (dao sqlDao) Shutdown() {
-	err := dao.Close()
+	err := dao.db.Close()
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func (dao sqlDao) PrintDatabaseState() {
-	printClients(dao)
-	printProducts(dao)
-	printCustomers(dao)
-	printCustomerProducts(dao)
-}
-
-func printClients(dao sqlDao) {
-	log.Printf("*** %-15s ***", "Clients")
-	clients, err := dao.Query("SELECT id, name, active, created_at, updated_at FROM client ORDER BY id")
-	if err != nil {
-		log.Fatal(err)
+func (dao sqlDao) Snapshot() (State, error) {
+	var state State
+	for _, client := range dao.ListClients(ListFilter{IncludeInactive: true}) {
+		state.Clients = append(state.Clients, NewClientRow(client))
 	}
-	defer clients.Close()
-	var (
-		id        int64
-		name      string
-		active    bool
-		createdAt time.Time
-		updatedAt time.Time
-	)
-	log.Printf("%-3s | %-40s | %s | %-20s | %-20s", "ID", "Name", "Active", "Created At", "Updated At")
-	log.Println(strings.Repeat("-", 101))
-	rowCount := 0
-	for ; clients.Next(); rowCount++ {
-		err = clients.Scan(&id, &name, &active, &createdAt, &updatedAt)
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Printf("%-3d | %-40s | %-6t | %20s | %20s", id, name, active, createdAt.Format(time.RFC822), updatedAt.Format(time.RFC822))
+	for _, product := range dao.ListProducts(ListFilter{IncludeInactive: true}) {
+		state.Products = append(state.Products, NewProductRow(product))
 	}
-	log.Printf("Total: %d row(s)", rowCount)
-}
-
-func printProducts(dao sqlDao) {
-	log.Printf("*** %-15s ***", "Products")
-	products, err := dao.Query("SELECT id, name, active, created_at, updated_at FROM product ORDER BY id")
-	if err != nil {
-		log.Fatal(err)
+	var err error
+	if state.Customers, err = dao.snapshotCustomers(); err != nil {
+		return state, err
 	}
-	defer products.Close()
-	var (
-		id        int64
-		name      string
-		active    bool
-		createdAt time.Time
-		updatedAt time.Time
-	)
-	log.Printf("%-3s | %-40s | %s | %-20s | %-20s", "ID", "Name", "Active", "Created At", "Updated At")
-	log.Println(strings.Repeat("-", 101))
-	rowCount := 0
-	for ; products.Next(); rowCount++ {
-		err = products.Scan(&id, &name, &active, &createdAt, &updatedAt)
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Printf("%-3d | %-40s | %-6t | %20s | %20s", id, name, active, createdAt.Format(time.RFC822), updatedAt.Format(time.RFC822))
+	if state.Links, err = dao.snapshotLinks(); err != nil {
+		return state, err
 	}
-	log.Printf("Total: %d row(s)", rowCount)
+	return state, nil
 }
 
-func printCustomers(dao sqlDao) {
-	log.Printf("*** %-15s ***", "Customers")
-	customers, err := dao.Query(`
-		SELECT c.id, c.code, c.first_name, c.last_name, c.email_address, cl.name, c.created_at, c.updated_at
+func (dao sqlDao) snapshotCustomers() ([]CustomerRow, error) {
+	rows, err := dao.Query(`
+		SELECT c.id, c.client_id, c.code, c.first_name, coalesce(c.middle_name, ''), c.last_name, c.email_address, cl.name, c.created_at, c.updated_at
 		FROM customer c
 		JOIN client cl ON cl.id = c.client_id
+		WHERE c.deleted_at IS NULL
 		ORDER BY c.id`)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer customers.Close()
-	var (
-		id           int64
-		code         string
-		firstName    string
-		lastName     string
-		emailAddress string
-		clientName   string
-		createdAt    time.Time
-		updatedAt    time.Time
-	)
-	log.Printf("%-3s | %-10s | %-20s | %-20s | %-40s | %-40s | %20s | %20s",
-		"ID",
-		"Code",
-		"First Name",
-		"Last Name",
-		"Email",
-		"Client",
-		"Created At",
-		"Updated At")
-	log.Println(strings.Repeat("-", 194))
-	rowCount := 0
-	for ; customers.Next(); rowCount++ {
-		err = customers.Scan(&id, &code, &firstName, &lastName, &emailAddress, &clientName, &createdAt, &updatedAt)
+	defer rows.Close()
+	var customers []CustomerRow
+	for rows.Next() {
+		var c CustomerRow
+		err = rows.Scan(&c.Id, &c.ClientId, &c.Code, &c.FirstName, &c.MiddleName, &c.LastName, &c.EmailAddress, &c.ClientName, &c.CreatedAt, &c.UpdatedAt)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		log.Printf("%-3d | %-10s | %-20s | %-20s | %-40s | %-40s | %20s | %20s",
-			id, code, firstName, lastName, emailAddress, clientName, createdAt.Format(time.RFC822), updatedAt.Format(time.RFC822))
+		customers = append(customers, c)
 	}
-	log.Printf("Total: %d row(s)", rowCount)
+	return customers, rows.Err()
 }
 
-func printCustomerProducts(dao sqlDao) {
-	log.Printf("*** %-15s ***", "Customer/Products")
-	customerProducts, err := dao.Query(`
-		SELECT c.code, c.first_name, c.last_name, p.name
+func (dao sqlDao) snapshotLinks() ([]LinkRow, error) {
+	rows, err := dao.Query(`
+		SELECT c.id, p.id, c.code, c.first_name, c.last_name, p.name
 		FROM customer c
 		INNER JOIN customer_product cp ON c.id = cp.customer_id
 		INNER JOIN product p ON cp.product_id = p.id
-		ORDER BY c.last_name`)
+		WHERE c.deleted_at IS NULL
+		  AND p.deleted_at IS NULL
+		ORDER BY c.last_name, c.first_name, p.name`)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer customerProducts.Close()
-	var (
-		code      string
-		firstName string
-		lastName  string
-		product   string
-	)
-	log.Printf("%-10s | %-20s | %-20s | %-40s", "Code", "First Name", "Last Name", "Product")
-	log.Println(strings.Repeat("-", 99))
-	rowCount := 0
-	for ; customerProducts.Next(); rowCount++ {
-		err = customerProducts.Scan(&code, &firstName, &lastName, &product)
-		if err != nil {
-			log.Fatal(err)
+	defer rows.Close()
+	var links []LinkRow
+	for rows.Next() {
+		var link LinkRow
+		if err = rows.Scan(&link.CustomerId, &link.ProductId, &link.Code, &link.FirstName, &link.LastName, &link.Product); err != nil {
+			return nil, err
 		}
-		log.Printf("%-10s | %-20s | %-20s | %-40s", code, firstName, lastName, product)
+		links = append(links, link)
 	}
-	log.Printf("Total: %d row(s)", rowCount)
+	return links, rows.Err()
 }
 
 func (dao sqlDao) InsertClient(name string) Client {
@@ -187,8 +137,13 @@ func (dao sqlDao) InsertCustomer(code, firstName string, lastName string, email
 	var id int64
 	err := dao.QueryRow(
 		`INSERT INTO customer (code, first_name, last_name, email_address, client_id)
-		VALUES ($1, $2, $3, $4, $5)
+		SELECT $1, $2, $3, $4, id
+		FROM client
+		WHERE id = $5 AND active AND deleted_at IS NULL
 		RETURNING id`, code, firstName, lastName, email, client.Id).Scan(&id)
+	if err == sql.ErrNoRows {
+		log.Fatal(ErrInactiveClient)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -208,124 +163,916 @@ func (dao sqlDao) InsertProduct(name string) Product {
 	return NewProduct(id)
 }
 
-func (dao sqlDao) UpdateCustomerName(customer Customer, newFullName string) {
+// BulkInsertCustomers loads the customers, which must carry their ClientId,
+// with a single COPY and returns their ids in the same order. COPY cannot
+// return generated keys, so the ids are drawn from the sequence up front.
+func (dao sqlDao) BulkInsertCustomers(customers []Customer) ([]int64, error) {
+	log.Println("Bulk insert", len(customers), "customers")
+	if len(customers) == 0 {
+		return nil, nil
+	}
+	var ids []int64
+	err := dao.inTx(func(tx sqlDao) error {
+		var err error
+		ids, err = tx.bulkInsertCustomers(customers)
+		return err
+	})
+	return ids, err
+}
+
+func (tx sqlDao) bulkInsertCustomers(customers []Customer) ([]int64, error) {
+	clientIds := DistinctClientIds(customers)
+	var activeClients int
+	err := tx.QueryRow(
+		`SELECT count(*)
+		FROM client
+		WHERE id = ANY($1) AND active AND deleted_at IS NULL`, pq.Array(clientIds)).Scan(&activeClients)
+	if err != nil {
+		return nil, err
+	}
+	if activeClients != len(clientIds) {
+		return nil, ErrInactiveClient
+	}
+	rows, err := tx.Query(
+		`SELECT nextval(pg_get_serial_sequence('customer', 'id'))
+		FROM generate_series(1, $1)`, len(customers))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(customers))
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	stmt, err := tx.tx.Prepare(pq.CopyIn("customer",
+		"id", "client_id", "code", "first_name", "middle_name", "last_name", "email_address"))
+	if err != nil {
+		return nil, err
+	}
+	for i, customer := range customers {
+		middleName := sql.NullString{String: customer.MiddleName, Valid: customer.MiddleName != ""}
+		_, err = stmt.Exec(ids[i], customer.ClientId, customer.Code,
+			customer.FirstName, middleName, customer.LastName, customer.EmailAddress)
+		if err != nil {
+			stmt.Close()
+			return nil, err
+		}
+	}
+	// The final argument-less Exec flushes the buffered rows to the server.
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		return nil, err
+	}
+	return ids, stmt.Close()
+}
+
+// UpsertCustomer inserts the customer, or updates the one with the same code
+// under the client. Rows that already hold these values are left alone, and a
+// soft-deleted match is brought back.
+func (dao sqlDao) UpsertCustomer(code, firstName string, lastName string, email string, client Client) (Customer, UpsertResult, error) {
+	log.Println("Upsert customer", code, "for client", client.Id)
+	var (
+		customer Customer
+		inserted bool
+	)
+	err := dao.QueryRow(
+		`INSERT INTO customer (code, first_name, last_name, email_address, client_id)
+		SELECT $1, $2, $3, $4, id
+		FROM client
+		WHERE id = $5 AND active AND deleted_at IS NULL
+		ON CONFLICT (client_id, code) DO UPDATE
+		SET first_name = EXCLUDED.first_name
+		  , last_name = EXCLUDED.last_name
+		  , email_address = EXCLUDED.email_address
+		  , deleted_at = NULL
+		  , version = customer.version + 1
+		  , updated_at = now()
+		WHERE (customer.first_name, customer.last_name, customer.email_address, customer.deleted_at IS NULL)
+		  IS DISTINCT FROM (EXCLUDED.first_name, EXCLUDED.last_name, EXCLUDED.email_address, TRUE)
+		RETURNING `+customerColumns+`, xmax = 0`,
+		code, firstName, lastName, email, client.Id).
+		Scan(append(customerFields(&customer), &inserted)...)
+	switch {
+	case err == nil && inserted:
+		return customer, Inserted, nil
+	case err == nil:
+		return customer, Updated, nil
+	case err != sql.ErrNoRows:
+		return customer, Unchanged, err
+	}
+	// Nothing came back: either the client may not take customers, or the row
+	// was already up to date.
+	customer, err = scanCustomer(dao.QueryRow(
+		`SELECT `+customerColumns+`
+		FROM customer
+		WHERE client_id = $1
+		  AND code = $2
+		  AND EXISTS (
+		    SELECT 1 FROM client
+		    WHERE id = $1 AND active AND deleted_at IS NULL)`, client.Id, code))
+	if err == ErrNotFound {
+		err = ErrInactiveClient
+	}
+	return customer, Unchanged, err
+}
+
+func (dao sqlDao) UpdateCustomerName(customer Customer, newFullName string) (Customer, error) {
 	log.Println("Update customer", customer.Id, "name to", newFullName)
 	newFirstName, newLastName, err := SplitFullName(newFullName)
 	if err != nil {
-		log.Fatal(err)
+		return customer, err
+	}
+	return dao.PatchCustomer(customer, CustomerPatch{
+		FirstName: &newFirstName,
+		LastName:  &newLastName,
+	})
+}
+
+func (dao sqlDao) UpdateProductName(product Product, newName string) (Product, error) {
+	log.Println("Update product", product.Id, "name to", newName)
+	return dao.PatchProduct(product, ProductPatch{Name: &newName})
+}
+
+func (dao sqlDao) UpdateCustomerEmailAndLinkToProduct(customer Customer, newEmail string, product Product) (Customer, error) {
+	log.Println("Update customer", customer.Id, "email address to", newEmail)
+	var updated Customer
+	err := dao.inTx(func(tx sqlDao) error {
+		var err error
+		updated, err = patchCustomer(tx, customer, CustomerPatch{EmailAddress: &newEmail})
+		if err != nil {
+			return err
+		}
+		return tx.LinkCustomerToProduct(updated, product)
+	})
+	if err != nil {
+		return customer, err
 	}
+	return updated, nil
+}
+
+// LinkCustomerToProduct is a no-op when the link already exists.
+func (dao sqlDao) LinkCustomerToProduct(customer Customer, product Product) error {
+	log.Println("Link product", product.Id, "to customer", customer.Id)
 	res, err := dao.Exec(
-		`UPDATE customer
-		SET first_name = $2
-		  , last_name = $3
-		WHERE id = $1`, customer.Id, newFirstName, newLastName)
+		`INSERT INTO customer_product (customer_id, product_id)
+		SELECT c.id, p.id
+		FROM customer c, product p
+		WHERE c.id = $1 AND c.deleted_at IS NULL
+		  AND p.id = $2 AND p.active AND p.deleted_at IS NULL
+		  AND NOT EXISTS (
+		    SELECT 1 FROM customer_product
+		    WHERE customer_id = $1 AND product_id = $2)`, customer.Id, product.Id)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	logAffectedRows("Link customer to product", res)
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected > 0 {
+		return nil
+	}
+	// Nothing was inserted: find out whether that is because of the customer,
+	// the product, or an existing link.
+	var customerExists, productActive bool
+	err = dao.QueryRow(
+		`SELECT
+		  EXISTS (SELECT 1 FROM customer WHERE id = $1 AND deleted_at IS NULL),
+		  EXISTS (SELECT 1 FROM product WHERE id = $2 AND active AND deleted_at IS NULL)`,
+		customer.Id, product.Id).Scan(&customerExists, &productActive)
+	switch {
+	case err != nil:
+		return err
+	case !customerExists:
+		return ErrNotFound
+	case !productActive:
+		return ErrInactiveProduct
 	}
-	logAffectedRows("Update customer name", res)
+	return nil
 }
 
-func (dao sqlDao) UpdateProductName(product Product, newName string) {
-	log.Println("Update product", product.Id, "name to", newName)
+func (dao sqlDao) DeleteClient(client Client) error {
+	log.Println("Delete client", client.Id)
 	res, err := dao.Exec(
-		`UPDATE product
-		SET name = $2
-		WHERE id = $1`, product.Id, newName)
+		`UPDATE client
+			SET deleted_at = now()
+			WHERE id = $1
+			  AND deleted_at IS NULL
+			  AND NOT EXISTS (
+			    SELECT 1 FROM customer
+			    WHERE client_id = $1 AND deleted_at IS NULL)`, client.Id)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	logAffectedRows("Delete client", res)
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected > 0 {
+		return nil
+	}
+	exists, err := liveRowExists(dao, "client", client.Id)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrClientHasCustomers
 	}
-	logAffectedRows("Update product name", res)
+	return ErrNotFound
 }
 
-func (dao sqlDao) UpdateCustomerEmailAndLinkToProduct(customer Customer, newEmail string, product Product) {
-	log.Println("Update customer", customer.Id, "email address to", newEmail)
-	tx, err := dao.Begin()
+// errDryRun rolls back the transaction of a dry run once it has been counted.
+var errDryRun = errors.New("Dry run")
+
+// DeleteClientCascade unlinks the client's live customers from their products,
+// then soft-deletes the customers and the client, all in one transaction. A
+// dry run does the same and rolls it back, so the counts are exact.
+func (dao sqlDao) DeleteClientCascade(client Client, dryRun bool) (CascadeReport, error) {
+	log.Println("Delete client", client.Id, "with its customers, dry run:", dryRun)
+	report := CascadeReport{DryRun: dryRun}
+	err := dao.inTx(func(tx sqlDao) error {
+		res, err := tx.Exec(
+			`DELETE FROM customer_product cp
+			USING customer c
+			WHERE c.id = cp.customer_id
+			  AND c.client_id = $1
+			  AND c.deleted_at IS NULL`, client.Id)
+		if err != nil {
+			return err
+		}
+		if report.Links, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		res, err = tx.Exec(
+			`UPDATE customer
+			SET deleted_at = now()
+			WHERE client_id = $1
+			  AND deleted_at IS NULL`, client.Id)
+		if err != nil {
+			return err
+		}
+		if report.Customers, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		res, err = tx.Exec(
+			`UPDATE client
+			SET deleted_at = now()
+			WHERE id = $1
+			  AND deleted_at IS NULL`, client.Id)
+		if err != nil {
+			return err
+		}
+		if report.Clients, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		if report.Clients == 0 {
+			return ErrNotFound
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		err = nil
+	}
 	if err != nil {
-		log.Fatal(err)
+		return CascadeReport{DryRun: dryRun}, err
 	}
-	res, err := tx.Exec(
-		`UPDATE customer
-			SET email_address = $2
-			WHERE id = $1`, customer.Id, newEmail)
+	log.Printf("%-20s: %d link(s), %d customer(s), %d client(s)", "Delete client cascade", report.Links, report.Customers, report.Clients)
+	return report, nil
+}
+
+// TransferCustomers moves live customers of fromClient over to toClient. Both
+// clients must be active, and none of the moved customer codes may already be
+// taken in toClient, soft-deleted customers included.
+func (dao sqlDao) TransferCustomers(fromClient Client, toClient Client, customerIds []int64) (int64, error) {
+	log.Println("Transfer", len(customerIds), "customer(s) from client", fromClient.Id, "to client", toClient.Id)
+	if fromClient.Id == toClient.Id {
+		return 0, ErrSameClient
+	}
+	ids := pq.Array(DistinctIds(customerIds))
+	var moved int64
+	err := dao.inTx(func(tx sqlDao) error {
+		// Locking both clients keeps them from being deactivated, and the
+		// target from gaining a colliding customer, until the move is done.
+		var activeClients int
+		err := tx.QueryRow(
+			`SELECT count(*) FROM (
+				SELECT id FROM client
+				WHERE id IN ($1, $2) AND active AND deleted_at IS NULL
+				FOR UPDATE) locked`, fromClient.Id, toClient.Id).Scan(&activeClients)
+		if err != nil {
+			return err
+		}
+		if activeClients != 2 {
+			return ErrInactiveClient
+		}
+		var found int
+		err = tx.QueryRow(
+			`SELECT count(*)
+			FROM customer
+			WHERE id = ANY($1)
+			  AND client_id = $2
+			  AND deleted_at IS NULL`, ids, fromClient.Id).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found != len(DistinctIds(customerIds)) {
+			return ErrNotFound
+		}
+		rows, err := tx.Query(
+			`SELECT t.code
+			FROM customer t
+			JOIN customer m ON m.code = t.code
+			WHERE m.id = ANY($1)
+			  AND t.client_id = $2
+			ORDER BY t.code`, ids, toClient.Id)
+		if err != nil {
+			return err
+		}
+		var codes []string
+		for rows.Next() {
+			var code string
+			if err = rows.Scan(&code); err != nil {
+				rows.Close()
+				return err
+			}
+			codes = append(codes, code)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if len(codes) > 0 {
+			return &CodeCollisionError{ClientId: toClient.Id, Codes: codes}
+		}
+		res, err := tx.Exec(
+			`UPDATE customer
+			SET client_id = $2
+			  , version = version + 1
+			  , updated_at = now()
+			WHERE id = ANY($1)`, ids, toClient.Id)
+		if err != nil {
+			return err
+		}
+		logAffectedRows("Transfer customers", res)
+		moved, err = res.RowsAffected()
+		return err
+	})
 	if err != nil {
-		tx.Rollback()
-		log.Fatal(err)
+		return 0, err
 	}
-	logAffectedRows("Update customer email", res)
-	log.Println("Link product", product.Id, "to customer", customer.Id)
-	res, err = tx.Exec(
-		`INSERT INTO customer_product (customer_id, product_id)
-		VALUES ($1, $2)`, customer.Id, product.Id)
+	return moved, nil
+}
+
+// FindDuplicateCustomers pairs up live customers of client that share an email
+// address, share a name once it is normalized, or whose full names are at
+// least DuplicateSimilarity alike. Each pair is reported once, by its strongest
+// match.
+func (dao sqlDao) FindDuplicateCustomers(client Client) ([]DuplicateCandidate, error) {
+	log.Println("Find duplicate customers of client", client.Id)
+	rows, err := dao.Query(
+		`SELECT a.id, b.id,
+			CASE
+				WHEN lower(a.email_address) = lower(b.email_address) THEN $3
+				WHEN `+normalizedName("a")+` = `+normalizedName("b")+` THEN $4
+				ELSE $5
+			END,
+			similarity(a.first_name || ' ' || a.last_name, b.first_name || ' ' || b.last_name)
+		FROM customer a
+		JOIN customer b ON b.client_id = a.client_id AND b.id > a.id
+		WHERE a.client_id = $1
+		  AND a.deleted_at IS NULL
+		  AND b.deleted_at IS NULL
+		  AND (lower(a.email_address) = lower(b.email_address)
+		    OR `+normalizedName("a")+` = `+normalizedName("b")+`
+		    OR similarity(a.first_name || ' ' || a.last_name, b.first_name || ' ' || b.last_name) >= $2)
+		ORDER BY a.id, b.id`,
+		client.Id, DuplicateSimilarity, string(MatchEmail), string(MatchName), string(MatchSimilarName))
 	if err != nil {
-		tx.Rollback()
-		log.Fatal(err)
+		return nil, err
 	}
-	logAffectedRows("Link customer to product", res)
-	tx.Commit()
+	var candidates []DuplicateCandidate
+	var ids []int64
+	for rows.Next() {
+		var candidate DuplicateCandidate
+		var match string
+		err = rows.Scan(&candidate.Customer.Id, &candidate.Duplicate.Id, &match, &candidate.Similarity)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidate.Match = DuplicateMatch(match)
+		candidates = append(candidates, candidate)
+		ids = append(ids, candidate.Customer.Id, candidate.Duplicate.Id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	rows, err = dao.Query("SELECT "+customerColumns+" FROM customer WHERE id = ANY($1)", pq.Array(DistinctIds(ids)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := make(map[int64]Customer)
+	for rows.Next() {
+		customer, err := scanCustomer(rows)
+		if err != nil {
+			return nil, err
+		}
+		found[customer.Id] = customer
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		candidates[i].Customer = found[candidates[i].Customer.Id]
+		candidates[i].Duplicate = found[candidates[i].Duplicate.Id]
+	}
+	return candidates, nil
 }
 
-func (dao sqlDao) DeleteClient(client Client) {
-	log.Println("Delete client", client.Id)
-	_, err := dao.Exec(
-		`DELETE FROM client
-			WHERE id = $1`, client.Id)
-	if err == nil {
-		log.Fatal("Delete client was not blocked by DB constraints")
+// normalizedName is the SQL expression for the first and last name of the
+// customer aliased as alias, lowercased and stripped of everything but letters.
+func normalizedName(alias string) string {
+	return "lower(regexp_replace(" + alias + ".first_name || " + alias + ".last_name, '[^[:alpha:]]', '', 'g'))"
+}
+
+// MergeCustomers folds duplicates into survivor: their product links move over
+// to the survivor, skipping products it is already linked to, and the
+// duplicates are deleted. The duplicates must be other live customers of the
+// survivor's client.
+func (dao sqlDao) MergeCustomers(survivor Customer, duplicates []Customer) error {
+	ids := make([]int64, len(duplicates))
+	for i, duplicate := range duplicates {
+		ids[i] = duplicate.Id
 	}
-	log.Println("Delete client was blocked by DB contraints, as expected")
+	ids = DistinctIds(ids)
+	log.Println("Merge", len(ids), "customer(s) into customer", survivor.Id)
+	return dao.inTx(func(tx sqlDao) error {
+		// Locking the survivor and the duplicates keeps them from being
+		// deleted or transferred while their links move.
+		var found int
+		err := tx.QueryRow(
+			`SELECT count(*) FROM (
+				SELECT d.id
+				FROM customer d
+				JOIN customer s ON s.client_id = d.client_id
+				WHERE d.id = ANY($1)
+				  AND d.id <> s.id
+				  AND s.id = $2
+				  AND d.deleted_at IS NULL
+				  AND s.deleted_at IS NULL
+				FOR UPDATE) locked`, pq.Array(ids), survivor.Id).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found != len(ids) {
+			return ErrInvalidMerge
+		}
+		res, err := tx.Exec(
+			`INSERT INTO customer_product (customer_id, product_id)
+			SELECT DISTINCT $1::bigint, cp.product_id
+			FROM customer_product cp
+			WHERE cp.customer_id = ANY($2)
+			  AND NOT EXISTS (
+				SELECT 1 FROM customer_product s
+				WHERE s.customer_id = $1 AND s.product_id = cp.product_id)`, survivor.Id, pq.Array(ids))
+		if err != nil {
+			return err
+		}
+		logAffectedRows("Move customer links", res)
+		res, err = tx.Exec("DELETE FROM customer_product WHERE customer_id = ANY($1)", pq.Array(ids))
+		if err != nil {
+			return err
+		}
+		logAffectedRows("Delete merged links", res)
+		res, err = tx.Exec("UPDATE customer SET deleted_at = now() WHERE id = ANY($1)", pq.Array(ids))
+		if err != nil {
+			return err
+		}
+		logAffectedRows("Delete merged", res)
+		return nil
+	})
 }
 
-func (dao sqlDao) UpdateClientName(client Client, newName string) {
+func (dao sqlDao) UpdateClientName(client Client, newName string) (Client, error) {
 	log.Println("Update client", client.Id, "name to", newName)
-	res, err := dao.Exec(
-		`UPDATE client
-			SET name = $2
-			WHERE id = $1`, client.Id, newName)
+	return dao.PatchClient(client, ClientPatch{Name: &newName})
+}
+
+func (dao sqlDao) PatchCustomer(customer Customer, patch CustomerPatch) (Customer, error) {
+	log.Println("Patch customer", customer.Id)
+	return patchCustomer(dao, customer, patch)
+}
+
+func (dao sqlDao) PatchProduct(product Product, patch ProductPatch) (Product, error) {
+	log.Println("Patch product", product.Id)
+	updated, err := scanProduct(patchRow(dao, "product", productColumns, product.Id, product.Version, patch.Columns()))
+	if err == ErrNotFound {
+		err = missingOrConflict(dao, "product", product.Id, product.Version)
+	}
+	if err != nil {
+		return product, err
+	}
+	return updated, nil
+}
+
+func (dao sqlDao) PatchClient(client Client, patch ClientPatch) (Client, error) {
+	log.Println("Patch client", client.Id)
+	updated, err := scanClient(patchRow(dao, "client", clientColumns, client.Id, client.Version, patch.Columns()))
+	if err == ErrNotFound {
+		err = missingOrConflict(dao, "client", client.Id, client.Version)
+	}
+	if err != nil {
+		return client, err
+	}
+	return updated, nil
+}
+
+// patchCustomer is shared by PatchCustomer and the transactional customer
+// updates, which run it against a *sql.Tx.
+func patchCustomer(db queryer, customer Customer, patch CustomerPatch) (Customer, error) {
+	updated, err := scanCustomer(patchRow(db, "customer", customerColumns, customer.Id, customer.Version, patch.Columns()))
+	if err == ErrNotFound {
+		err = missingOrConflict(db, "customer", customer.Id, customer.Version)
+	}
+	if err != nil {
+		return customer, err
+	}
+	return updated, nil
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// patchRow updates only the given columns of a live row that is still at the
+// given version, bumping version and updated_at, and returns the row as it is
+// afterwards. An empty patch changes nothing and just reads the row back.
+func patchRow(db queryer, table string, returning string, id int64, version int64, columns map[string]interface{}) *sql.Row {
+	if len(columns) == 0 {
+		return db.QueryRow(
+			`SELECT `+returning+`
+			FROM `+table+`
+			WHERE id = $1
+			  AND deleted_at IS NULL`, id)
+	}
+	names := make([]string, 0, len(columns))
+	for name := range columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := []interface{}{id, version}
+	var set strings.Builder
+	for _, name := range names {
+		args = append(args, columns[name])
+		fmt.Fprintf(&set, "%s = $%d, ", name, len(args))
+	}
+	return db.QueryRow(
+		`UPDATE `+table+`
+			SET `+set.String()+`version = version + 1
+			  , updated_at = now()
+			WHERE id = $1
+			  AND version = $2
+			  AND deleted_at IS NULL
+			RETURNING `+returning, args...)
+}
+
+// missingOrConflict explains why a version-guarded update matched no rows:
+// either the row is gone or it moved on to another version.
+func missingOrConflict(db queryer, table string, id int64, version int64) error {
+	exists, err := liveRowExists(db, table, id)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return &ConflictError{Table: table, Id: id, Version: version}
+	}
+	return ErrNotFound
+}
+
+func liveRowExists(db queryer, table string, id int64) (bool, error) {
+	var exists bool
+	err := db.QueryRow(
+		`SELECT EXISTS (
+			SELECT 1 FROM `+table+`
+			WHERE id = $1 AND deleted_at IS NULL)`, id).Scan(&exists)
+	return exists, err
+}
+
+func (dao sqlDao) ActivateClient(client Client) (Client, error) {
+	log.Println("Activate client", client.Id)
+	return scanClient(dao.setActive("client", clientColumns, client.Id, true))
+}
+
+func (dao sqlDao) DeactivateClient(client Client) (Client, error) {
+	log.Println("Deactivate client", client.Id)
+	return scanClient(dao.setActive("client", clientColumns, client.Id, false))
+}
+
+func (dao sqlDao) ActivateProduct(product Product) (Product, error) {
+	log.Println("Activate product", product.Id)
+	return scanProduct(dao.setActive("product", productColumns, product.Id, true))
+}
+
+func (dao sqlDao) DeactivateProduct(product Product) (Product, error) {
+	log.Println("Deactivate product", product.Id)
+	return scanProduct(dao.setActive("product", productColumns, product.Id, false))
+}
+
+// setActive flips the active flag of a client or product row. The table name
+// is never user input, so it is safe to splice into the statement.
+func (dao sqlDao) setActive(table string, returning string, id int64, active bool) *sql.Row {
+	return dao.QueryRow(
+		`UPDATE `+table+`
+			SET active = $2
+			  , version = version + 1
+			  , updated_at = now()
+			WHERE id = $1
+			  AND deleted_at IS NULL
+			RETURNING `+returning, id, active)
+}
+
+func (dao sqlDao) ListClients(filter ListFilter) []Client {
+	rows, err := dao.Query(
+		`SELECT `+clientColumns+`
+		FROM client
+		WHERE deleted_at IS NULL
+		  AND (active OR $1)
+		ORDER BY id`, filter.IncludeInactive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	var clients []Client
+	for rows.Next() {
+		client, err := scanClient(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clients = append(clients, client)
+	}
+	if err = rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return clients
+}
+
+func (dao sqlDao) ListProducts(filter ListFilter) []Product {
+	rows, err := dao.Query(
+		`SELECT `+productColumns+`
+		FROM product
+		WHERE deleted_at IS NULL
+		  AND (active OR $1)
+		ORDER BY id`, filter.IncludeInactive)
 	if err != nil {
 		log.Fatal(err)
 	}
-	logAffectedRows("Update client name", res)
+	defer rows.Close()
+	var products []Product
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		products = append(products, product)
+	}
+	if err = rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return products
 }
 
-func (dao sqlDao) DeleteCustomer(customer Customer) {
+func (dao sqlDao) DeleteCustomer(customer Customer) error {
 	log.Println("Delete customer", customer.Id)
 	res, err := dao.Exec(
-		`DELETE FROM customer
-			WHERE id = $1`, customer.Id)
+		`UPDATE customer
+			SET deleted_at = now()
+			WHERE id = $1
+			  AND deleted_at IS NULL`, customer.Id)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	logAffectedRows("Delete customer", res)
+	return checkFound(res)
 }
 
-func (dao sqlDao) DeleteAllCustomers() {
+func (dao sqlDao) DeleteAllCustomers(confirm string) (int64, error) {
 	log.Println("Delete all customers")
-	res, err := dao.Exec(`DELETE FROM customer`)
+	return dao.deleteAll("customer", confirm)
+}
+
+func (dao sqlDao) DeleteAllProducts(confirm string) (int64, error) {
+	log.Println("Delete all products")
+	return dao.deleteAll("product", confirm)
+}
+
+func (dao sqlDao) DeleteAllClients(confirm string) (int64, error) {
+	log.Println("Delete all clients")
+	var customerCount int64
+	err := dao.QueryRow(`SELECT count(*) FROM customer WHERE deleted_at IS NULL`).Scan(&customerCount)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	logAffectedRows("Delete all customers", res)
+	if customerCount > 0 {
+		return 0, ErrClientHasCustomers
+	}
+	return dao.deleteAll("client", confirm)
 }
 
-func (dao sqlDao) DeleteAllProducts() {
-	log.Println("Delete all products")
-	res, err := dao.Exec(`DELETE FROM product`)
+// deleteAll soft-deletes every live row of table once CheckMassDelete allows
+// it, logging how many rows are about to go first.
+func (dao sqlDao) deleteAll(table string, confirm string) (int64, error) {
+	var count int64
+	err := dao.QueryRow("SELECT count(*) FROM " + table + " WHERE deleted_at IS NULL").Scan(&count)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
+	}
+	log.Printf("%-20s: %d row(s) to delete", "Delete all "+table+"s", count)
+	if err = CheckMassDelete(dao.params, confirm); err != nil {
+		return 0, err
 	}
-	logAffectedRows("Delete all products", res)
+	res, err := dao.Exec(
+		`UPDATE ` + table + `
+			SET deleted_at = now()
+			WHERE deleted_at IS NULL`)
+	if err != nil {
+		return 0, err
+	}
+	logAffectedRows("Delete all "+table+"s", res)
+	return res.RowsAffected()
 }
 
-func (dao sqlDao) DeleteAllClients() {
-	log.Println("Delete all clients")
-	res, err := dao.Exec(`DELETE FROM client`)
+func (dao sqlDao) RestoreCustomer(customer Customer) (Customer, error) {
+	log.Println("Restore customer", customer.Id)
+	return scanCustomer(dao.QueryRow(
+		`UPDATE customer c
+			SET deleted_at = NULL
+			  , version = version + 1
+			  , updated_at = now()
+			WHERE c.id = $1
+			  AND c.deleted_at IS NOT NULL
+			  AND EXISTS (
+			    SELECT 1 FROM client cl
+			    WHERE cl.id = c.client_id AND cl.deleted_at IS NULL)
+			RETURNING `+customerColumns, customer.Id))
+}
+
+func (dao sqlDao) RestoreProduct(product Product) (Product, error) {
+	log.Println("Restore product", product.Id)
+	return scanProduct(dao.QueryRow(
+		`UPDATE product
+			SET deleted_at = NULL
+			  , version = version + 1
+			  , updated_at = now()
+			WHERE id = $1
+			  AND deleted_at IS NOT NULL
+			RETURNING `+productColumns, product.Id))
+}
+
+func (dao sqlDao) RestoreClient(client Client) (Client, error) {
+	log.Println("Restore client", client.Id)
+	return scanClient(dao.QueryRow(
+		`UPDATE client
+			SET deleted_at = NULL
+			  , version = version + 1
+			  , updated_at = now()
+			WHERE id = $1
+			  AND deleted_at IS NOT NULL
+			RETURNING `+clientColumns, client.Id))
+}
+
+// Purge hard-deletes the records soft-deleted more than olderThan ago, along
+// with their links, and returns how many records went; links are not counted.
+// It compares deleted_at with a cutoff the database works out, since it is the
+// database clock that stamped deleted_at in the first place.
+func (dao sqlDao) Purge(olderThan time.Duration) (int64, error) {
+	log.Println("Purge records deleted more than", olderThan, "ago")
+	cutoff := olderThan.Seconds()
+	var purged int64
+	err := dao.inTx(func(tx sqlDao) error {
+		purged = 0
+		res, err := tx.Exec(
+			`DELETE FROM customer_product cp
+			USING customer c, product p
+			WHERE c.id = cp.customer_id
+			  AND p.id = cp.product_id
+			  AND (c.deleted_at < now() - make_interval(secs => $1) OR p.deleted_at < now() - make_interval(secs => $1))`, cutoff)
+		if err != nil {
+			return err
+		}
+		logAffectedRows("Purge links", res)
+		for _, table := range []string{"customer", "product"} {
+			res, err = tx.Exec(`DELETE FROM `+table+` WHERE deleted_at < now() - make_interval(secs => $1)`, cutoff)
+			if err != nil {
+				return err
+			}
+			logAffectedRows("Purge "+table, res)
+			rowsAffected, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			purged += rowsAffected
+		}
+		res, err = tx.Exec(
+			`DELETE FROM client cl
+			WHERE cl.deleted_at < now() - make_interval(secs => $1)
+			  AND NOT EXISTS (
+			    SELECT 1 FROM customer c
+			    WHERE c.client_id = cl.id)`, cutoff)
+		if err != nil {
+			return err
+		}
+		logAffectedRows("Purge client", res)
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		purged += rowsAffected
+		return nil
+	})
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	logAffectedRows("Delete all clients", res)
+	return purged, nil
 }
 
 func logAffectedRows(prefix string, res sql.Result) {
 	rowsAffected, _ := res.RowsAffected()
 	log.Printf("%-20s: %d row(s) affected", prefix, rowsAffected)
 }
+
+// checkFound turns a single-row update or delete that matched nothing into
+// ErrNotFound.
+func checkFound(res sql.Result) error {
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const (
+	clientColumns   = "id, name, active, created_at, updated_at, deleted_at, version"
+	productColumns  = "id, name, active, created_at, updated_at, deleted_at, version"
+	customerColumns = "id, client_id, code, first_name, coalesce(middle_name, ''), last_name, email_address, created_at, updated_at, deleted_at, version"
+)
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// The scan* functions read rows selected with the matching *Columns list. A
+// single-row statement that matched nothing comes back as ErrNotFound.
+
+func scanClient(row scanner) (Client, error) {
+	var client Client
+	err := row.Scan(&client.Id, &client.Name, &client.Active,
+		&client.CreatedAt, &client.UpdatedAt, &client.DeletedAt, &client.Version)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return client, err
+}
+
+func scanProduct(row scanner) (Product, error) {
+	var product Product
+	err := row.Scan(&product.Id, &product.Name, &product.Active,
+		&product.CreatedAt, &product.UpdatedAt, &product.DeletedAt, &product.Version)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return product, err
+}
+
+func scanCustomer(row scanner) (Customer, error) {
+	var customer Customer
+	err := row.Scan(customerFields(&customer)...)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return customer, err
+}
+
+// customerFields lists the scan destinations for customerColumns, for queries
+// that return extra columns after them.
+func customerFields(customer *Customer) []interface{} {
+	return []interface{}{&customer.Id, &customer.ClientId, &customer.Code,
+		&customer.FirstName, &customer.MiddleName, &customer.LastName, &customer.EmailAddress,
+		&customer.CreatedAt, &customer.UpdatedAt, &customer.DeletedAt, &customer.Version}
+}
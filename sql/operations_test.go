@@ -0,0 +1,20 @@
+package sql
+
+import (
+	. "go-learn-sql/common"
+	"go-learn-sql/common/dbtest"
+	"testing"
+)
+
+func TestDeleteAllRefusedInProtectedProfile(t *testing.T) {
+	params := dbtest.Params(t)
+	t.Setenv(ProtectedEnv, "true")
+	dao := InitWith(params)
+	defer dao.Shutdown()
+	if !dao.params.Protected {
+		t.Fatalf("%s=true did not open a protected dao", ProtectedEnv)
+	}
+	if _, err := dao.DeleteAllCustomers(MassDeleteToken); err != ErrMassDeleteProtected {
+		t.Errorf("DeleteAllCustomers() = %v, want %v", err, ErrMassDeleteProtected)
+	}
+}
@@ -0,0 +1,113 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	. "go-learn-sql/common"
+	"log"
+)
+
+func (dao sqlDao) WithTx(options TxOptions, fn func(tx Dao) error) error {
+	return dao.withTx(options, func(tx sqlDao) error {
+		return fn(tx)
+	})
+}
+
+// inTx is withTx with the default options and retry policy, for the
+// operations that need several statements to succeed or fail together.
+func (dao sqlDao) inTx(fn func(tx sqlDao) error) error {
+	return dao.withTx(TxOptions{Retry: DefaultRetryPolicy}, fn)
+}
+
+// withTx runs fn against a dao bound to a transaction, committing if fn
+// returns nil and rolling back otherwise, and retries the lot as the options'
+// policy allows. A dao that is already in a transaction runs fn under a
+// savepoint instead, so that a failing fn only undoes its own work.
+func (dao sqlDao) withTx(options TxOptions, fn func(tx sqlDao) error) error {
+	if dao.tx != nil {
+		return dao.withSavepoint(fn)
+	}
+	return options.Retry.Run(onRetry(options), func() error {
+		tx, err := dao.db.BeginTx(context.Background(), &sql.TxOptions{
+			Isolation: options.Isolation,
+			ReadOnly:  options.ReadOnly,
+		})
+		if err != nil {
+			return err
+		}
+		// A panic in fn rolls back before it carries on, so that the
+		// connection is not left holding an open transaction.
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				tx.Rollback()
+				panic(recovered)
+			}
+		}()
+		err = fn(sqlDao{queryer: tx, db: dao.db, tx: tx, params: dao.params})
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// withSavepoint names the savepoint after the nesting depth, so that inner
+// savepoints never shadow the ones they are nested in.
+func (dao sqlDao) withSavepoint(fn func(tx sqlDao) error) error {
+	nested := dao
+	nested.depth++
+	name := fmt.Sprintf("sp_%d", nested.depth)
+	if _, err := dao.Exec(`SAVEPOINT ` + name); err != nil {
+		return err
+	}
+	if err := fn(nested); err != nil {
+		if _, rollbackErr := dao.Exec(`ROLLBACK TO SAVEPOINT ` + name); rollbackErr != nil {
+			log.Println("Rollback to savepoint", name, "failed:", rollbackErr)
+		}
+		return err
+	}
+	_, err := dao.Exec(`RELEASE SAVEPOINT ` + name)
+	return err
+}
+
+// onRetry logs every retry before passing it on to the caller's hook.
+func onRetry(options TxOptions) func(attempt int, err error) {
+	return func(attempt int, err error) {
+		log.Println("Retrying transaction after attempt", attempt, "failed:", err)
+		if options.OnRetry != nil {
+			options.OnRetry(attempt, err)
+		}
+	}
+}
+
+// errBatchFailed rolls back an all-or-nothing batch with a failed item; the
+// item's own error is in the report.
+var errBatchFailed = errors.New("Batch failed")
+
+func (dao sqlDao) RunBatch(operations []Operation, mode BatchMode) (BatchReport, error) {
+	log.Println("Run batch of", len(operations), "operation(s)")
+	var report BatchReport
+	attempts := 0
+	err := dao.inTx(func(tx sqlDao) error {
+		attempts++
+		report = ApplyBatch(tx, operations, mode)
+		if !report.Committed {
+			return report.RollbackError(errBatchFailed)
+		}
+		return nil
+	})
+	report.Attempts = attempts
+	if err == errBatchFailed {
+		err = nil
+	}
+	// The last attempt may have run every item and still failed to commit,
+	// or run out of retries.
+	if err != nil {
+		report.Committed = false
+	}
+	log.Printf("Batch: %d of %d operation(s) failed, committed: %t", report.Failed(), len(operations), report.Committed)
+	return report, err
+}
@@ -0,0 +1,36 @@
+package sql
+
+import (
+	. "go-learn-sql/common"
+	"go-learn-sql/common/dbtest"
+	"testing"
+)
+
+func TestWithTxRollsBackOnPanic(t *testing.T) {
+	params := dbtest.Params(t)
+	dao := InitWith(params)
+	defer dao.Shutdown()
+	var client Client
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != "boom" {
+				t.Errorf("recovered %v, want the panic from fn", recovered)
+			}
+		}()
+		dao.WithTx(TxOptions{}, func(tx Dao) error {
+			client = tx.InsertClient("Panicking Client")
+			t.Cleanup(func() { dbtest.PurgeClient(t, params, client.Id) })
+			panic("boom")
+		})
+	}()
+	var count int
+	if err := dao.db.QueryRow("SELECT count(*) FROM client WHERE id = $1", client.Id).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("the client inserted before the panic was committed")
+	}
+	if stats := dao.db.Stats(); stats.InUse != 0 {
+		t.Errorf("%d connection(s) still in use after the panic", stats.InUse)
+	}
+}